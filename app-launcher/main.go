@@ -1,49 +1,86 @@
 package main
 
 import (
+	"flag"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
-	"os/signal"
 	"path"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/marcozj/k8s-secret-injection/internal/redact"
+	"github.com/marcozj/k8s-secret-injection/internal/rules"
 	"k8s.io/klog"
 )
 
 const (
 	secretsFilesPath = "/centrify/secrets"
+	// completeManifestFile is written by secret injector after all secret files are in place. It lists them one per line,
+	// as "NAME" or "NAME=file name" if the file isn't named after its env var.
+	completeManifestFile = ".complete"
+	defaultReadyTimeout  = 120 * time.Second
+
+	collisionOverride     = "override"      // secret replaces env var of the same name
+	collisionKeepExisting = "keep-existing" // env var of the same name is kept and the secret is ignored
+	collisionFail         = "fail"          // app launcher fails without starting program
 )
 
+// secretFile is a secret file listed in completion manifest
+type secretFile struct {
+	name string // env var name
+	file string // file name in secrets directory
+}
+
 func main() {
-	var entrypointCmd []string
-	if len(os.Args) == 1 {
+	secretsDirPtr := flag.String("secrets-dir", secretsFilesPath, "Directory that secret files are read from")
+	readyTimeoutPtr := flag.Duration("ready-timeout", envDurationOrDefault("CFYVAULT_READY_TIMEOUT", defaultReadyTimeout), "Time to wait for secret injection to complete. Defaults to CFYVAULT_READY_TIMEOUT env")
+	onCollisionPtr := flag.String("on-collision", envOrDefault("CFYVAULT_ON_COLLISION", collisionOverride), "Policy when a secret file has the name of an existing env var: override, keep-existing or fail. Defaults to CFYVAULT_ON_COLLISION env")
+	supervisePtr := flag.Bool("supervise", envBoolOrDefault("CFYVAULT_SUPERVISE", false), "Run program as child process instead of replacing app launcher with it. Defaults to CFYVAULT_SUPERVISE env")
+	onChangePtr := flag.String("on-change", envOrDefault("CFYVAULT_ON_CHANGE", onChangeNone), "Action in supervise mode when secret files change: none, signal or restart. Defaults to CFYVAULT_ON_CHANGE env")
+	reloadSignalPtr := flag.String("reload-signal", envOrDefault("CFYVAULT_RELOAD_SIGNAL", "SIGHUP"), "Signal sent to program when secret files change if on-change is signal. Defaults to CFYVAULT_RELOAD_SIGNAL env")
+	stopTimeoutPtr := flag.Duration("stop-timeout", envDurationOrDefault("CFYVAULT_STOP_TIMEOUT", defaultStopTimeout), "Time to wait for program to exit after SIGTERM before killing it on restart. Defaults to CFYVAULT_STOP_TIMEOUT env")
+	flag.Usage = func() {
+		fmt.Printf("Usage: centrify-app-launcher [options] command [args...]\n")
+		flag.PrintDefaults()
+	}
+	// Parsing stops at the first non-flag argument, which is the original command
+	flag.Parse()
+
+	switch *onCollisionPtr {
+	case collisionOverride, collisionKeepExisting, collisionFail:
+	default:
+		klog.Errorf("Incorrect on-collision parameter %s", *onCollisionPtr)
+		os.Exit(1)
+	}
+	switch *onChangePtr {
+	case onChangeNone, onChangeSignal, onChangeRestart:
+	default:
+		klog.Errorf("Incorrect on-change parameter %s", *onChangePtr)
+		os.Exit(1)
+	}
+	reloadSignal, err := rules.ParseSignal(*reloadSignalPtr)
+	if err != nil {
+		klog.Errorf("Incorrect reload-signal parameter: %v", err)
+		os.Exit(1)
+	}
+
+	entrypointCmd := flag.Args()
+	if len(entrypointCmd) == 0 {
 		// a 'command' attribute must be set on images in pod manifest. If not we cannot start the expected process
 		klog.Errorf("no command is explicityly provided, %s can't determine image entrypoint", os.Args[0])
 		os.Exit(1)
-	} else {
-		entrypointCmd = os.Args[1:]
 	}
 
-	// Wait for secret files to be created in case of using sidecar method
-	counter := 30
-	for i := 1; i <= counter; i++ {
-		empty, err := isDirEmpty(secretsFilesPath)
-		if err != nil {
-			klog.Errorf("Secret file path %s doesn't exist.", secretsFilesPath)
-			os.Exit(1)
-		}
-		if empty {
-			klog.Infof("Waiting for secret file %d...", i)
-			time.Sleep(1 * time.Second)
-		} else {
-			klog.Infof("Secret file created")
-			break
-		}
+	// Wait for secret injection to complete, in case of using sidecar method
+	secretsDir := *secretsDirPtr
+	files, err := waitForSecrets(secretsDir, *readyTimeoutPtr)
+	if err != nil {
+		klog.Errorf("%v", err)
+		os.Exit(1)
 	}
 
 	binary, err := exec.LookPath(entrypointCmd[0])
@@ -51,29 +88,29 @@ func main() {
 		klog.Fatalln(err.Error())
 	}
 
-	secretsFiles, err := ioutil.ReadDir(secretsFilesPath)
+	// Get currently defined env vars plus new ones from fetched secrets
+	env, err := buildEnv(secretsDir, files, *onCollisionPtr)
 	if err != nil {
-		klog.Fatalln(err.Error())
+		klog.Errorf("%v", err)
+		os.Exit(1)
 	}
+	klog.Infof("New envs: %v\n", redact.Env(env, envNames(files)...))
 
-	// Get currently defined env vars
-	env := os.Environ()
-
-	for _, f := range secretsFiles {
-		filePath := path.Join(secretsFilesPath, f.Name())
-		klog.Infof("Secrets file=%s", filePath)
-		content, err := ioutil.ReadFile(filePath)
-		if err != nil {
-			klog.Fatalln(err)
+	if *supervisePtr {
+		s := &supervisor{
+			binary:       binary,
+			argv:         entrypointCmd,
+			secretsDir:   secretsDir,
+			onCollision:  *onCollisionPtr,
+			onChange:     *onChangePtr,
+			reloadSignal: reloadSignal,
+			stopTimeout:  *stopTimeoutPtr,
+			pollInterval: defaultPollInterval,
 		}
-		newenv := fmt.Sprintf("%s=%s", f.Name(), string(content))
-
-		// Add to env vars. We do not check for collisions: make sure to not have same keys in secrets files (and do not use existing env keys either)
-		env = append(env, newenv)
+		os.Exit(s.run(env))
 	}
 
 	// Replace current process with original one, providing env vars (including new ones from fetched secrets)
-	klog.Infof("New envs: %v\n", env)
 	klog.Infof("Starting original program: %v ...\n", entrypointCmd)
 	err = syscall.Exec(binary, entrypointCmd, env)
 	if err != nil {
@@ -81,89 +118,164 @@ func main() {
 	}
 }
 
-func isDirEmpty(name string) (bool, error) {
-	f, err := os.Open(name)
-	if err != nil {
-		return false, err
-	}
-	defer f.Close()
+// buildEnv returns currently defined env vars followed by one for every secret file.
+// Secret files that have the name of a currently defined env var are handled according to collision policy.
+func buildEnv(secretsDir string, files []secretFile, onCollision string) ([]string, error) {
+	env := os.Environ()
 
-	// read in ONLY one file
-	_, err = f.Readdir(1)
+	for _, f := range files {
+		name := f.name
+		if hasEnv(env, name) {
+			switch onCollision {
+			case collisionKeepExisting:
+				klog.Infof("Keeping existing env var %s, ignoring secret file of the same name", name)
+				continue
+			case collisionFail:
+				return nil, fmt.Errorf("Secret file %s collides with existing env var of the same name", name)
+			default:
+				// Remove placeholder, such as the env var declared empty in pod spec, so that only the secret is defined
+				klog.Infof("Overriding existing env var %s with secret file of the same name", name)
+				env = removeEnv(env, name)
+			}
+		}
 
-	// and if the file is EOF... well, the dir is empty.
-	if err == io.EOF {
-		return true, nil
+		filePath := path.Join(secretsDir, f.file)
+		klog.Infof("Secrets file=%s", filePath)
+		content, err := ioutil.ReadFile(filePath)
+		if err != nil {
+			return nil, err
+		}
+		newenv := fmt.Sprintf("%s=%s", name, string(content))
+		env = append(env, newenv)
 	}
-	return false, err
+	return env, nil
 }
 
-func mainold() {
-	var entrypointCmd []string
-	if len(os.Args) == 1 {
-		klog.Errorf("no command is given, %s can't determine the entrypoint (command)", os.Args[0])
-		os.Exit(1)
-	} else {
-		entrypointCmd = os.Args[1:]
+// envNames returns env var names of secret files
+func envNames(files []secretFile) []string {
+	var names []string
+	for _, f := range files {
+		names = append(names, f.name)
 	}
+	return names
+}
 
-	binary, err := exec.LookPath(entrypointCmd[0])
-	if err != nil {
-		klog.Errorf("binary not found %v", entrypointCmd[0])
-		os.Exit(1)
+// hasEnv reports whether env contains an entry for name
+func hasEnv(env []string, name string) bool {
+	for _, e := range env {
+		if strings.HasPrefix(e, name+"=") {
+			return true
+		}
 	}
+	return false
+}
 
-	// Get currently defined env vars
-	env := os.Environ()
-
-	var injectedEnvs []string
-	injectedEnvs = append(injectedEnvs, "WORDPRESS_DB_PASSWORD=kjaklsdjfklajfl")
+// removeEnv returns env without any entry for name
+func removeEnv(env []string, name string) []string {
+	result := env[:0]
+	for _, e := range env {
+		if !strings.HasPrefix(e, name+"=") {
+			result = append(result, e)
+		}
+	}
+	return result
+}
 
-	env = append(env, injectedEnvs...)
+// waitForSecrets waits until secret injector has written the completion manifest and every secret file it lists
+// exists, then returns the secret files
+func waitForSecrets(dir string, timeout time.Duration) ([]secretFile, error) {
+	if _, err := os.Stat(dir); err != nil {
+		return nil, fmt.Errorf("Secret file path %s doesn't exist", dir)
+	}
 
-	klog.Infoln("spawning process:", entrypointCmd)
-	cmd := exec.Command(binary, entrypointCmd[1:]...)
-	cmd.Env = append(os.Environ(), injectedEnvs...)
-	cmd.Stdin = os.Stdin
-	cmd.Stderr = os.Stderr
-	cmd.Stdout = os.Stdout
-	os.Setenv("WORDPRESS_DB_PASSWORD", "kjflsjdlfjlks")
+	manifestPath := path.Join(dir, completeManifestFile)
+	deadline := time.Now().Add(timeout)
+	for i := 1; ; i++ {
+		files, err := readManifest(manifestPath)
+		if err == nil {
+			missing := missingFiles(dir, files)
+			if len(missing) == 0 {
+				klog.Infof("Secret injection completed with %d secret file(s)", len(files))
+				return files, nil
+			}
+			err = fmt.Errorf("secret file(s) %s listed in %s are missing", strings.Join(missing, ", "), manifestPath)
+		} else if !os.IsNotExist(err) {
+			return nil, fmt.Errorf("Failed to read %s: %v", manifestPath, err)
+		} else {
+			err = fmt.Errorf("%s not found", manifestPath)
+		}
 
-	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs)
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("Secret injection did not complete within %v: %v", timeout, err)
+		}
+		klog.Infof("Waiting for secret injection to complete %d...", i)
+		time.Sleep(1 * time.Second)
+	}
+}
 
-	err = cmd.Start()
+// readManifest returns secret files listed in completion manifest, one per line
+func readManifest(manifestPath string) ([]secretFile, error) {
+	content, err := ioutil.ReadFile(manifestPath)
 	if err != nil {
-		klog.Errorf("failed to start process %v with error %v", entrypointCmd, err.Error())
-		os.Exit(1)
+		return nil, err
 	}
+	var files []secretFile
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		split := strings.SplitN(line, "=", 2)
+		f := secretFile{name: split[0], file: split[0]}
+		if len(split) == 2 {
+			f.file = split[1]
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
 
-	go func() {
-		for sig := range sigs {
-			// We don't want to signal a non-running process.
-			if cmd.ProcessState != nil && cmd.ProcessState.Exited() {
-				break
-			}
-
-			err := cmd.Process.Signal(sig)
-			if err != nil {
-				klog.Infof("failed to signal process with %s: %v", sig, err)
-			} else {
-				klog.Infof("received signal: %s", sig)
-			}
+// missingFiles returns names of secret files that do not exist in dir
+func missingFiles(dir string, files []secretFile) []string {
+	var missing []string
+	for _, f := range files {
+		if _, err := os.Stat(path.Join(dir, f.file)); err != nil {
+			missing = append(missing, f.file)
 		}
-	}()
+	}
+	return missing
+}
 
-	err = cmd.Wait()
+// envOrDefault returns value of environment variable or the default if it is not set
+func envOrDefault(name string, defaultValue string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return defaultValue
+}
 
-	close(sigs)
+// envBoolOrDefault returns boolean value of environment variable or the default if it is not set or invalid
+func envBoolOrDefault(name string, defaultValue bool) bool {
+	switch value := strings.ToLower(os.Getenv(name)); value {
+	case "":
+	case "y", "yes", "true", "on", "1":
+		return true
+	case "n", "no", "false", "off", "0":
+		return false
+	default:
+		klog.Warningf("Ignoring invalid %s value %s", name, value)
+	}
+	return defaultValue
+}
 
-	if _, ok := err.(*exec.ExitError); ok {
-		os.Exit(cmd.ProcessState.ExitCode())
-	} else if err != nil {
-		klog.Fatalln("failed to exec process", entrypointCmd, err.Error())
-		os.Exit(-1)
-	} else {
-		os.Exit(cmd.ProcessState.ExitCode())
+// envDurationOrDefault returns duration value of environment variable or the default if it is not set or invalid
+func envDurationOrDefault(name string, defaultValue time.Duration) time.Duration {
+	if value := os.Getenv(name); value != "" {
+		d, err := time.ParseDuration(value)
+		if err == nil {
+			return d
+		}
+		klog.Warningf("Ignoring invalid %s value %s", name, value)
 	}
+	return defaultValue
 }
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path"
+	"syscall"
+	"time"
+
+	"github.com/marcozj/k8s-secret-injection/internal/redact"
+	"k8s.io/klog"
+)
+
+const (
+	// changeEventFile is rewritten by secret injector in watch mode every time secret files change
+	changeEventFile = ".changed"
+
+	onChangeNone    = "none"    // leave program running with secrets it started with
+	onChangeSignal  = "signal"  // send reload signal to program, which re-reads secret files itself
+	onChangeRestart = "restart" // restart program with new secrets in its environment
+
+	defaultStopTimeout  = 10 * time.Second
+	defaultPollInterval = 2 * time.Second
+)
+
+// supervisor runs program as child process, forwards signals to it and reacts to changed secret files.
+// Running as PID 1 of the container, it also reaps orphaned processes.
+type supervisor struct {
+	binary       string
+	argv         []string
+	secretsDir   string
+	onCollision  string
+	onChange     string
+	reloadSignal syscall.Signal
+	stopTimeout  time.Duration
+	pollInterval time.Duration
+
+	child      *exec.Cmd
+	restarting bool   // child is being stopped to be started again
+	lastEvent  []byte // last content of change event file
+}
+
+// run starts program with env and supervises it until it exits. It returns exit code to exit with.
+func (s *supervisor) run(env []string) int {
+	// Register before starting the child so that neither its exit nor any signal is missed
+	sigs := make(chan os.Signal, 32)
+	signal.Notify(sigs)
+	defer signal.Stop(sigs)
+
+	s.lastEvent, _ = ioutil.ReadFile(path.Join(s.secretsDir, changeEventFile))
+	if err := s.start(env); err != nil {
+		klog.Errorf("failed to start process %v with error %v", s.argv, err)
+		return 1
+	}
+
+	var poll <-chan time.Time
+	if s.onChange != onChangeNone {
+		ticker := time.NewTicker(s.pollInterval)
+		defer ticker.Stop()
+		poll = ticker.C
+	}
+	var kill <-chan time.Time
+
+	for {
+		select {
+		case sig := <-sigs:
+			switch sig {
+			case syscall.SIGCHLD:
+				status, exited := s.reap()
+				if !exited {
+					continue
+				}
+				if !s.restarting {
+					code := exitCode(status)
+					klog.Infof("Process %v exited with code %d", s.argv, code)
+					return code
+				}
+				s.restarting = false
+				kill = nil
+				env, err := s.reloadEnv()
+				if err == nil {
+					err = s.start(env)
+				}
+				if err != nil {
+					klog.Errorf("failed to restart process %v with error %v", s.argv, err)
+					return 1
+				}
+			case syscall.SIGURG:
+				// Used internally by Go runtime for preemption
+			default:
+				if err := s.child.Process.Signal(sig); err != nil {
+					klog.Infof("failed to signal process with %s: %v", sig, err)
+				} else {
+					klog.Infof("received signal: %s", sig)
+				}
+				// The child stops for good if it is told to, even during a restart
+				if sig == syscall.SIGTERM || sig == syscall.SIGINT {
+					s.restarting = false
+				}
+			}
+		case <-poll:
+			if !s.secretsChanged() || s.restarting {
+				continue
+			}
+			switch s.onChange {
+			case onChangeSignal:
+				klog.Infof("Secret files changed, sending %s to process", s.reloadSignal)
+				if err := s.child.Process.Signal(s.reloadSignal); err != nil {
+					klog.Infof("failed to signal process with %s: %v", s.reloadSignal, err)
+				}
+			case onChangeRestart:
+				klog.Infof("Secret files changed, restarting process")
+				s.restarting = true
+				if err := s.child.Process.Signal(syscall.SIGTERM); err != nil {
+					klog.Infof("failed to signal process with %s: %v", syscall.SIGTERM, err)
+				}
+				kill = time.After(s.stopTimeout)
+			}
+		case <-kill:
+			klog.Infof("Process did not exit within %v, killing it", s.stopTimeout)
+			s.child.Process.Kill()
+		}
+	}
+}
+
+// start spawns program with env, sharing standard streams of app launcher
+func (s *supervisor) start(env []string) error {
+	klog.Infoln("spawning process:", s.argv)
+	cmd := exec.Command(s.binary, s.argv[1:]...)
+	cmd.Args = s.argv
+	cmd.Env = env
+	cmd.Stdin = os.Stdin
+	cmd.Stderr = os.Stderr
+	cmd.Stdout = os.Stdout
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	s.child = cmd
+	return nil
+}
+
+// reap collects every exited child process, including orphans re-parented to app launcher as PID 1.
+// It reports whether the supervised program is among them and its wait status.
+func (s *supervisor) reap() (syscall.WaitStatus, bool) {
+	var childStatus syscall.WaitStatus
+	childExited := false
+	for {
+		var status syscall.WaitStatus
+		pid, err := syscall.Wait4(-1, &status, syscall.WNOHANG, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil || pid <= 0 {
+			return childStatus, childExited
+		}
+		if pid == s.child.Process.Pid {
+			childStatus = status
+			childExited = true
+		}
+	}
+}
+
+// secretsChanged reports whether secret injector has emitted a change event since last call
+func (s *supervisor) secretsChanged() bool {
+	content, err := ioutil.ReadFile(path.Join(s.secretsDir, changeEventFile))
+	if err != nil || len(content) == 0 || bytes.Equal(content, s.lastEvent) {
+		return false
+	}
+	s.lastEvent = content
+	return true
+}
+
+// reloadEnv builds env from secret files currently listed in completion manifest
+func (s *supervisor) reloadEnv() ([]string, error) {
+	files, err := waitForSecrets(s.secretsDir, s.stopTimeout)
+	if err != nil {
+		return nil, err
+	}
+	env, err := buildEnv(s.secretsDir, files, s.onCollision)
+	if err != nil {
+		return nil, err
+	}
+	klog.Infof("New envs: %v\n", redact.Env(env, envNames(files)...))
+	return env, nil
+}
+
+// exitCode returns exit code of a process, using shell convention of 128 plus signal number if it was killed
+func exitCode(status syscall.WaitStatus) int {
+	if status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return status.ExitStatus()
+}
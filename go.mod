@@ -6,9 +6,11 @@ require (
 	github.com/golang/glog v0.0.0-20160126235308-23def4e6c14b
 	github.com/google/martian v2.1.0+incompatible
 	github.com/marcozj/golang-sdk v0.1.1
+	github.com/prometheus/client_golang v1.7.1
 	golang.org/x/crypto v0.0.0-20210220033148-5ea612d1eb83
+	gopkg.in/yaml.v2 v2.2.8
 	k8s.io/api v0.19.2
 	k8s.io/apimachinery v0.19.2
 	k8s.io/klog v1.0.0
+	sigs.k8s.io/yaml v1.2.0
 )
-
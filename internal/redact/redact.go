@@ -0,0 +1,164 @@
+// Package redact masks secret values before they are written to logs.
+//
+// Values are replaced by a fixed mask. Setting VAULT_REDACT_DEBUG=true replaces them by a short SHA-256 hash
+// instead, so that values can be compared across logs without being revealed.
+package redact
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"strings"
+	"unicode"
+)
+
+const (
+	// DebugEnv is the environment variable that enables showing hashes of masked values
+	DebugEnv = "VAULT_REDACT_DEBUG"
+	mask     = "[REDACTED]"
+)
+
+var showHash = isTrue(os.Getenv(DebugEnv))
+
+// sensitiveWords are words in a variable or annotation name that indicate its value is secret
+var sensitiveWords = map[string]bool{
+	"TOKEN":          true,
+	"PASSWORD":       true,
+	"PASSWD":         true,
+	"SECRET":         true,
+	"CREDENTIAL":     true,
+	"ENROLLMENTCODE": true,
+	"ENROLLMENT":     true,
+	"APIKEY":         true,
+}
+
+// referenceWords are last words of a name whose value refers to a secret rather than holds it, such as VAULT_PASSWORD_FILE
+var referenceWords = map[string]bool{
+	"NAME": true,
+	"FILE": true,
+	"PATH": true,
+}
+
+// SetDebug enables or disables showing hashes of masked values
+func SetDebug(on bool) {
+	showHash = on
+}
+
+// Value masks a secret value
+func Value(v string) string {
+	if !showHash {
+		return mask
+	}
+	sum := sha256.Sum256([]byte(v))
+	return "[REDACTED sha256:" + hex.EncodeToString(sum[:])[:12] + "]"
+}
+
+// IsSensitive tells whether the name of an environment variable or annotation indicates its value is secret
+func IsSensitive(name string) bool {
+	words := strings.FieldsFunc(strings.ToUpper(name), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	if len(words) == 0 || referenceWords[words[len(words)-1]] {
+		return false
+	}
+	for _, w := range words {
+		if sensitiveWords[w] {
+			return true
+		}
+	}
+	return false
+}
+
+// Env returns a copy of "NAME=value" entries with values masked if NAME is one of names or is sensitive
+func Env(env []string, names ...string) []string {
+	masked := make(map[string]bool, len(names))
+	for _, n := range names {
+		masked[n] = true
+	}
+	result := make([]string, 0, len(env))
+	for _, e := range env {
+		split := strings.SplitN(e, "=", 2)
+		if len(split) == 2 && (masked[split[0]] || IsSensitive(split[0])) {
+			e = split[0] + "=" + Value(split[1])
+		}
+		result = append(result, e)
+	}
+	return result
+}
+
+// Map returns a copy of m, such as pod annotations, with values of sensitive keys masked
+func Map(m map[string]string) map[string]string {
+	result := make(map[string]string, len(m))
+	for k, v := range m {
+		if IsSensitive(k) {
+			v = Value(v)
+		}
+		result[k] = v
+	}
+	return result
+}
+
+// JSON returns a copy of JSON document, such as AdmissionReview or JSON patch, with secret values masked.
+// String values of sensitive keys are masked, and so are values of {"name": ..., "value": ...} objects, the
+// shape of container env vars, whose name is sensitive. String values of JSON patch operations are masked if
+// their path is the value of a container env var or a sensitive annotation. Data that is not valid JSON is masked entirely.
+func JSON(data []byte) string {
+	var doc interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return Value(string(data))
+	}
+	redacted, err := json.Marshal(redactJSON(doc))
+	if err != nil {
+		return Value(string(data))
+	}
+	return string(redacted)
+}
+
+func redactJSON(doc interface{}) interface{} {
+	switch v := doc.(type) {
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(v))
+		name, _ := v["name"].(string)
+		path, _ := v["path"].(string)
+		for key, value := range v {
+			if s, ok := value.(string); ok && (IsSensitive(key) || (key == "value" && (IsSensitive(name) || isSensitivePath(path)))) {
+				result[key] = Value(s)
+			} else {
+				result[key] = redactJSON(value)
+			}
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, value := range v {
+			result[i] = redactJSON(value)
+		}
+		return result
+	default:
+		return v
+	}
+}
+
+// isSensitivePath tells whether JSON patch path, such as "/spec/containers/0/env/1/value" or
+// "/metadata/annotations/vault.centrify.com~1token", points to the value of an env var or a sensitive annotation.
+// Env var values are masked whatever their name since the operation doesn't tell it.
+func isSensitivePath(path string) bool {
+	segments := strings.Split(path, "/")
+	n := len(segments)
+	if n >= 4 && segments[n-3] == "env" && segments[n-1] == "value" {
+		return true
+	}
+	if n == 4 && segments[1] == "metadata" && segments[2] == "annotations" {
+		return IsSensitive(strings.NewReplacer("~1", "/", "~0", "~").Replace(segments[3]))
+	}
+	return false
+}
+
+func isTrue(value string) bool {
+	switch strings.ToLower(value) {
+	case "y", "yes", "true", "on", "1":
+		return true
+	}
+	return false
+}
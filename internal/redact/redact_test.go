@@ -0,0 +1,185 @@
+package redact
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestIsSensitive(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"VAULT_TOKEN", true},
+		{"VAULT_PASSWORD", true},
+		{"DB_PASSWD", true},
+		{"CLIENT_SECRET", true},
+		{"AWS_CREDENTIAL", true},
+		{"VAULT_ENROLLMENTCODE", true},
+		{"ENROLLMENT_CODE", true},
+		{"APIKEY", true},
+		{"vault.centrify.com/token", true},
+		{"vault.centrify.com/enrollment-code", true},
+		{"vault.centrify.com/vaultsecret_DB_PASSWORD", true},
+		{"secret-key", true},
+		{"VAULT_PASSWORD_FILE", false},
+		{"VAULT_TOKEN_FILE", false},
+		{"vault.centrify.com/token-file", false},
+		{"vault.centrify.com/oauth-secret-name", false},
+		{"SECRET_PATH", false},
+		{"VAULT_URL", false},
+		{"VAULT_APPID", false},
+		{"PASSWORDLESS", false},
+		{"", false},
+		{"___", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsSensitive(tt.name); got != tt.want {
+				t.Errorf("IsSensitive(%q) = %v, want %v", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValue(t *testing.T) {
+	defer SetDebug(showHash)
+
+	SetDebug(false)
+	if got := Value("s3cr3t"); got != mask {
+		t.Errorf("Value() = %q, want %q", got, mask)
+	}
+
+	SetDebug(true)
+	got := Value("s3cr3t")
+	if !strings.HasPrefix(got, "[REDACTED sha256:") || strings.Contains(got, "s3cr3t") {
+		t.Errorf("Value() in debug mode = %q, want hash", got)
+	}
+	if Value("s3cr3t") != got {
+		t.Error("Value() in debug mode differs for the same value")
+	}
+	if Value("other") == got {
+		t.Error("Value() in debug mode is the same for different values")
+	}
+}
+
+func TestEnv(t *testing.T) {
+	defer SetDebug(showHash)
+	SetDebug(false)
+
+	env := []string{
+		"PATH=/usr/bin",
+		"VAULT_TOKEN=abc",
+		"VAULT_TOKEN_FILE=/var/secrets/token",
+		"DB_CONN=user:pass@db",
+		"EMPTY_PASSWORD=",
+		"NOVALUE",
+	}
+	want := []string{
+		"PATH=/usr/bin",
+		"VAULT_TOKEN=" + mask,
+		"VAULT_TOKEN_FILE=/var/secrets/token",
+		"DB_CONN=" + mask,
+		"EMPTY_PASSWORD=" + mask,
+		"NOVALUE",
+	}
+	if got := Env(env, "DB_CONN"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Env() = %q, want %q", got, want)
+	}
+	if env[1] != "VAULT_TOKEN=abc" {
+		t.Errorf("Env() modified its argument: %q", env)
+	}
+}
+
+func TestMap(t *testing.T) {
+	defer SetDebug(showHash)
+	SetDebug(false)
+
+	m := map[string]string{
+		"vault.centrify.com/token":             "abc",
+		"vault.centrify.com/token-file":        "/var/secrets/token",
+		"vault.centrify.com/oauth-secret-name": "vault-token",
+		"vault.centrify.com/tenant-url":        "https://tenant.example.com",
+	}
+	want := map[string]string{
+		"vault.centrify.com/token":             mask,
+		"vault.centrify.com/token-file":        "/var/secrets/token",
+		"vault.centrify.com/oauth-secret-name": "vault-token",
+		"vault.centrify.com/tenant-url":        "https://tenant.example.com",
+	}
+	if got := Map(m); !reflect.DeepEqual(got, want) {
+		t.Errorf("Map() = %v, want %v", got, want)
+	}
+	if m["vault.centrify.com/token"] != "abc" {
+		t.Error("Map() modified its argument")
+	}
+}
+
+func TestJSON(t *testing.T) {
+	defer SetDebug(showHash)
+	SetDebug(false)
+
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{
+			name: "env vars of container",
+			data: `{"env":[{"name":"VAULT_TOKEN","value":"abc"},{"name":"VAULT_URL","value":"https://tenant.example.com"},` +
+				`{"name":"VAULT_TOKEN_FILE","value":"/var/secrets/token"}]}`,
+			want: `{"env":[{"name":"VAULT_TOKEN","value":"` + mask + `"},{"name":"VAULT_URL","value":"https://tenant.example.com"},` +
+				`{"name":"VAULT_TOKEN_FILE","value":"/var/secrets/token"}]}`,
+		},
+		{
+			name: "annotations",
+			data: `{"metadata":{"annotations":{"vault.centrify.com/token":"abc","vault.centrify.com/mutate":"yes"}}}`,
+			want: `{"metadata":{"annotations":{"vault.centrify.com/mutate":"yes","vault.centrify.com/token":"` + mask + `"}}}`,
+		},
+		{
+			name: "JSON patch",
+			data: `[{"op":"add","path":"/spec/initContainers","value":[{"name":"init","env":[{"name":"DB_PASSWORD","value":"vault://secret/db"}]}]}]`,
+			want: `[{"op":"add","path":"/spec/initContainers","value":[{"env":[{"name":"DB_PASSWORD","value":"` + mask + `"}],"name":"init"}]}]`,
+		},
+		{
+			name: "JSON patch of env var value",
+			data: `[{"op":"replace","path":"/spec/containers/0/env/1/value","value":"abc"},{"op":"add","path":"/spec/containers/0/env/-","value":{"name":"VAULT_URL","value":"https://tenant.example.com"}}]`,
+			want: `[{"op":"replace","path":"/spec/containers/0/env/1/value","value":"` + mask + `"},{"op":"add","path":"/spec/containers/0/env/-","value":{"name":"VAULT_URL","value":"https://tenant.example.com"}}]`,
+		},
+		{
+			name: "JSON patch of annotations",
+			data: `[{"op":"add","path":"/metadata/annotations/vault.centrify.com~1token","value":"abc"},{"op":"add","path":"/metadata/annotations/vault.centrify.com~1status","value":"injected"}]`,
+			want: `[{"op":"add","path":"/metadata/annotations/vault.centrify.com~1token","value":"` + mask + `"},{"op":"add","path":"/metadata/annotations/vault.centrify.com~1status","value":"injected"}]`,
+		},
+		{
+			name: "non-string values of sensitive keys",
+			data: `{"secret":{"password":"abc","size":3},"tokens":[1,2]}`,
+			want: `{"secret":{"password":"` + mask + `","size":3},"tokens":[1,2]}`,
+		},
+		{
+			name: "env var shape with non-string name",
+			data: `{"name":1,"value":"abc"}`,
+			want: `{"name":1,"value":"abc"}`,
+		},
+		{
+			name: "invalid JSON",
+			data: `{"token":`,
+			want: mask,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := JSON([]byte(tt.data))
+			if got != tt.want {
+				t.Errorf("JSON() = %s, want %s", got, tt.want)
+			}
+			if got != mask && !json.Valid([]byte(got)) {
+				t.Errorf("JSON() = %s is not valid JSON", got)
+			}
+		})
+	}
+}
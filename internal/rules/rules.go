@@ -0,0 +1,126 @@
+// Package rules holds the rules that webhook server checks annotations against and that secret injector and
+// app launcher enforce at runtime, so that a pod admitted by webhook server doesn't fail once it runs.
+package rules
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/template"
+)
+
+const (
+	OutputDotenv = "dotenv"
+	OutputJSON   = "json"
+	OutputYAML   = "yaml"
+)
+
+// DefaultOutputFiles are names of aggregate output files unless specified as "format:name"
+var DefaultOutputFiles = map[string]string{
+	OutputDotenv: "secrets.env",
+	OutputJSON:   "secrets.json",
+	OutputYAML:   "secrets.yaml",
+}
+
+// reloadSignals are signals that can be used as reload signal by name
+var reloadSignals = map[string]syscall.Signal{
+	"SIGHUP":   syscall.SIGHUP,
+	"SIGINT":   syscall.SIGINT,
+	"SIGQUIT":  syscall.SIGQUIT,
+	"SIGTERM":  syscall.SIGTERM,
+	"SIGUSR1":  syscall.SIGUSR1,
+	"SIGUSR2":  syscall.SIGUSR2,
+	"SIGWINCH": syscall.SIGWINCH,
+}
+
+// Output is an aggregate output file of secret injector
+type Output struct {
+	Format string
+	File   string
+}
+
+// ParseOutputs parses comma separated aggregate output formats, each optionally followed by ":file name",
+// for example "dotenv,json:config.json"
+func ParseOutputs(value string) ([]Output, error) {
+	var outputs []Output
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		split := strings.SplitN(item, ":", 2)
+		format := split[0]
+		name, ok := DefaultOutputFiles[format]
+		if !ok {
+			return nil, fmt.Errorf("unknown output format %s, must be %q, %q or %q", format, OutputDotenv, OutputJSON, OutputYAML)
+		}
+		if len(split) == 2 {
+			name = split[1]
+		}
+		if err := CheckFileName(name); err != nil {
+			return nil, err
+		}
+		outputs = append(outputs, Output{Format: format, File: name})
+	}
+	return outputs, nil
+}
+
+// CheckFileName verifies that name is a plain file name that doesn't hide or replace marker files
+func CheckFileName(name string) error {
+	if name == "" || strings.ContainsAny(name, "/\\") || strings.HasPrefix(name, ".") {
+		return fmt.Errorf("invalid file name %q", name)
+	}
+	return nil
+}
+
+// ParseTemplate parses Go text/template rendered into file name. Secrets are referenced by their env var name,
+// for example "password: {{ .DB_PASSWORD }}" or "password: {{ secret "DB_PASSWORD" | json }}"
+func ParseTemplate(name string, text string) (*template.Template, error) {
+	if err := CheckFileName(name); err != nil {
+		return nil, err
+	}
+	return template.New(name).Option("missingkey=error").Funcs(TemplateFuncs(nil)).Parse(text)
+}
+
+// TemplateFuncs returns functions available in templates. secrets is nil while parsing.
+func TemplateFuncs(secrets map[string]string) template.FuncMap {
+	return template.FuncMap{
+		"secret": func(name string) (string, error) {
+			value, ok := secrets[name]
+			if !ok {
+				return "", fmt.Errorf("secret %s is not defined", name)
+			}
+			return value, nil
+		},
+		"json": func(value interface{}) (string, error) {
+			b, err := json.Marshal(value)
+			return string(b), err
+		},
+		"quote":  DotenvQuote,
+		"trim":   strings.TrimSpace,
+		"indent": func(n int, s string) string { return strings.Replace(s, "\n", "\n"+strings.Repeat(" ", n), -1) },
+	}
+}
+
+// DotenvQuote double quotes value, escaping characters that are special in dotenv files
+func DotenvQuote(value string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`, "\n", `\n`)
+	return `"` + r.Replace(value) + `"`
+}
+
+// ParseSignal parses reload signal name such as "SIGHUP" or "HUP", or signal number
+func ParseSignal(value string) (syscall.Signal, error) {
+	name := strings.ToUpper(value)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	if sig, ok := reloadSignals[name]; ok {
+		return sig, nil
+	}
+	if n, err := strconv.Atoi(value); err == nil && n > 0 && n < 32 {
+		return syscall.Signal(n), nil
+	}
+	return 0, fmt.Errorf("unknown signal %q, must be one of SIGHUP, SIGINT, SIGQUIT, SIGTERM, SIGUSR1, SIGUSR2, SIGWINCH or a signal number", value)
+}
@@ -8,6 +8,7 @@ do
         counter=0
         echo "cagent is in connected state" >> $LOG
         echo "Injecting credentials..." >> $LOG
+        # Keeps running and refreshes secrets if VAULT_WATCH_INTERVAL is set
         /usr/local/bin/centrify-secret-injector -auth dmc -url $VAULT_URL -scope $VAULT_SCOPE >> $LOG
     else
         echo "waiting $counter..." >> $LOG
@@ -4,6 +4,12 @@ echo "Copy centrify application launcher"
 cp ${BINDIR}/centrify-app-launcher /centrify/bin/
 echo "Injecting credentials..."
 if [ "$VAULT_AUTHTYPE" = "oauth" ]; then
-    # Use fake token string since the binary will try to get it from /var/secrets/oauthtoken inside container
-    ${BINDIR}/centrify-secret-injector -auth oauth -url $VAULT_URL -appid $VAULT_APPID -scope $VAULT_SCOPE -token "faketoken"
+    # Token is taken from VAULT_TOKEN env, or token file at VAULT_TOKEN_FILE or /var/secrets/oauthtoken
+    ${BINDIR}/centrify-secret-injector -auth oauth -url $VAULT_URL -appid $VAULT_APPID -scope $VAULT_SCOPE
+elif [ "$VAULT_AUTHTYPE" = "unpw" ]; then
+    # User and password file are taken from VAULT_USER and VAULT_PASSWORD_FILE env
+    ${BINDIR}/centrify-secret-injector -auth unpw -url $VAULT_URL
+elif [ "$VAULT_AUTHTYPE" = "k8s" ]; then
+    # Projected ServiceAccount token is exchanged at VAULT_TOKEN_ENDPOINT, or OAuth2 token endpoint of appid
+    ${BINDIR}/centrify-secret-injector -auth k8s -url $VAULT_URL -appid "$VAULT_APPID" -scope $VAULT_SCOPE
 fi
\ No newline at end of file
@@ -42,11 +42,13 @@ done
 # injector binary will be executed by systemd so it can't see shell env variables
 # source environment variables from the file instead
 ENV_FILE="/usr/local/bin/centrify-secret-injector.env"
-echo "VAULT_URL=$VAULT_URL" >> $ENV_FILE
-echo "VAULT_APPID=$VAULT_APPID" >> $ENV_FILE
+# All VAULT_* variables and secret references, including multi-line templates, are handed over as JSON
+# so that sidecar injects the same files with the same options as init container
+ENV_JSON_FILE="/usr/local/bin/centrify-secret-injector.env.json"
+/usr/local/bin/centrify-secret-injector -dump-env "$ENV_JSON_FILE" || exit 1
+echo "VAULT_URL=$VAULT_URL" > $ENV_FILE
 echo "VAULT_SCOPE=$VAULT_SCOPE" >> $ENV_FILE
-echo "VAULT_AUTHTYPE=$VAULT_AUTHTYPE" >> $ENV_FILE
-env | grep "vault://" >> $ENV_FILE
+echo "VAULT_ENV_FILE=$ENV_JSON_FILE" >> $ENV_FILE
 
 /usr/sbin/cenroll -t $VAULT_URL -F dmc --code $VAULT_ENROLLMENTCODE "${CMDPARAM[@]}" -f &
 
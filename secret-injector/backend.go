@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+)
+
+// SecretBackend resolves a parsed vaultObject into the content of the secret
+type SecretBackend interface {
+	Resolve(vo vaultObject) ([]byte, error)
+}
+
+// backendFactory creates the SecretBackend that serves a URI scheme using injector settings
+type backendFactory func(vi *vaultInjector) (SecretBackend, error)
+
+func init() {
+	registerBackend(vaultScheme, newVaultBackend)
+}
+
+// backendFactories is the registry of backends keyed by URI scheme, for example "vault" for "vault://secret/name"
+var backendFactories = map[string]backendFactory{}
+
+// registerBackend makes a backend available for references using the URI scheme
+func registerBackend(scheme string, factory backendFactory) {
+	if _, exist := backendFactories[scheme]; exist {
+		panic(fmt.Sprintf("backend for scheme %s is already registered", scheme))
+	}
+	backendFactories[scheme] = factory
+}
+
+// initBackends creates one backend for every URI scheme referenced by parsed secrets
+func (vi *vaultInjector) initBackends() error {
+	vi.backends = make(map[string]SecretBackend)
+	for _, v := range vi.secrets {
+		if _, ok := vi.backends[v.scheme]; ok {
+			continue
+		}
+		factory, ok := backendFactories[v.scheme]
+		if !ok {
+			return fmt.Errorf("No backend registered for scheme %s", v.scheme)
+		}
+		backend, err := factory(vi)
+		if err != nil {
+			return err
+		}
+		vi.backends[v.scheme] = backend
+	}
+	return nil
+}
+
+// backendName names the backend serving URI scheme in reports, "centrify" or "file" for "vault://" references
+func (vi *vaultInjector) backendName(scheme string) string {
+	if scheme != vaultScheme {
+		return scheme
+	}
+	if vi.auth == "file" {
+		return "file"
+	}
+	return "centrify"
+}
+
+// newVaultBackend creates the backend serving "vault://" references. Authentication type "file"
+// serves them from a local fixture file, any other type from Centrify tenant.
+func newVaultBackend(vi *vaultInjector) (SecretBackend, error) {
+	if vi.auth == "file" {
+		return newFileBackend(vi.fixtureFile)
+	}
+	return newCentrifyBackend(vi)
+}
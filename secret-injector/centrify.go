@@ -0,0 +1,354 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/marcozj/golang-sdk/dmc"
+	"github.com/marcozj/golang-sdk/oauth"
+	"github.com/marcozj/golang-sdk/platform"
+	"github.com/marcozj/golang-sdk/restapi"
+	"github.com/marcozj/golang-sdk/webcookie"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// centrifyBackend checks out secrets and account passwords from Centrify tenant
+type centrifyBackend struct {
+	client *restapi.RestClient
+	retry  retryPolicy
+}
+
+// newCentrifyBackend authenticates to Centrify tenant using the configured authentication type
+func newCentrifyBackend(vi *vaultInjector) (SecretBackend, error) {
+	var authenticate func() error
+	switch vi.auth {
+	case "oauth":
+		authenticate = vi.getOauthRestClient
+	case "dmc":
+		authenticate = vi.getDMCRestClient
+	case "unpw":
+		authenticate = vi.getUnpwRestClient
+	case "k8s":
+		authenticate = vi.getServiceAccountRestClient
+	default:
+		return nil, fmt.Errorf("Unsupported authentication type: %s", vi.auth)
+	}
+
+	err := vi.retry.do("Authentication", authenticate)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to get %s rest client: %v", vi.auth, err)
+	}
+	vi.vaultClient.Client.Timeout = vi.retry.requestTimeout
+
+	return &centrifyBackend{client: vi.vaultClient, retry: vi.retry}, nil
+}
+
+// getOauthRestClient authenticates with OAuth2 access token. Token is taken from -token parameter,
+// VAULT_TOKEN env or token file in that order, see getOauthToken.
+func (vi *vaultInjector) getOauthRestClient() error {
+	accessToken, err := vi.getOauthToken()
+	if err != nil {
+		return err
+	}
+	call := oauth.OauthClient{
+		Service:        vi.url,
+		AppID:          vi.appid,
+		Scope:          vi.scope,
+		SkipCertVerify: vi.skipcert,
+	}
+	token := oauth.TokenResponse{
+		AccessToken: accessToken,
+		//AccessToken: t,
+		TokenType: "Bearer",
+	}
+
+	vi.vaultClient, err = call.GetRestClient(&token)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (vi *vaultInjector) getDMCRestClient() error {
+	call := dmc.DMC{}
+	call.Service = vi.url
+	call.Scope = vi.scope
+	call.Token = vi.token
+	call.SkipCertVerify = vi.skipcert
+
+	var err error
+	vi.vaultClient, err = call.GetClient()
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// getUnpwRestClient logs in to tenant with username and password. Password is taken from -password parameter,
+// VAULT_PASSWORD env or password file in that order. Only if none of them is set and stdin is a terminal,
+// password is prompted for interactively.
+func (vi *vaultInjector) getUnpwRestClient() error {
+	password, err := vi.getPassword()
+	if err != nil {
+		return err
+	}
+
+	if password == "" {
+		if !terminal.IsTerminal(int(os.Stdin.Fd())) {
+			return fmt.Errorf("No password provided for user %s", vi.user)
+		}
+		// Interactive login prompts for password and any additional challenges such as MFA
+		call := webcookie.WebCookie{}
+		call.Service = vi.url
+		call.ClientID = vi.user
+		call.SkipCertVerify = vi.skipcert
+		vi.vaultClient, err = call.GetClient()
+		return err
+	}
+
+	var clientFactory restapi.HttpClientFactory = func() *http.Client {
+		return &http.Client{}
+	}
+	if vi.skipcert {
+		// Ignore certificate error for on-prem deployment
+		tr := &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}
+		clientFactory = func() *http.Client {
+			return &http.Client{Transport: tr}
+		}
+	}
+	client, err := restapi.GetNewRestClient(vi.url, clientFactory)
+	if err != nil {
+		return err
+	}
+	client.Client.Timeout = vi.retry.requestTimeout
+
+	body, err := client.CallRawAPI("/Security/StartAuthentication", map[string]interface{}{
+		"User":    vi.user,
+		"Version": "1.0",
+	})
+	if err != nil {
+		return err
+	}
+	startResp, err := webcookie.NewAuthResponse(body)
+	if err != nil {
+		return err
+	}
+	if !startResp.Success {
+		return fmt.Errorf("Failed to initiate authentication: %s", startResp.Message)
+	}
+
+	// Answer every challenge with password. Challenges that can't be answered with password require interactive login.
+	for _, challenge := range startResp.Result.Challenges {
+		var mechanismID string
+		for _, mech := range challenge.Mechanisms {
+			if mech.Name == "UP" {
+				mechanismID = mech.MechanismID
+				break
+			}
+		}
+		if mechanismID == "" {
+			return fmt.Errorf("User %s requires authentication mechanism other than password", vi.user)
+		}
+
+		body, err = client.CallRawAPI("/Security/AdvanceAuthentication", map[string]interface{}{
+			"TenantId":    startResp.Result.TenantID,
+			"SessionId":   startResp.Result.SessionID,
+			"MechanismId": mechanismID,
+			"Action":      "Answer",
+			"Answer":      password,
+		})
+		if err != nil {
+			return err
+		}
+		advanceResp, err := webcookie.NewAdvanceAuthResponse(body)
+		if err != nil {
+			return err
+		}
+		if !advanceResp.Success {
+			return fmt.Errorf("Authentication failed: %s", advanceResp.Message)
+		}
+		if advanceResp.Result["Summary"] == "LoginSuccess" {
+			break
+		}
+	}
+
+	// Authentication cookie is kept in cookie jar of the client. Also send it as bearer token.
+	serviceURL, err := url.Parse(client.Service)
+	if err != nil {
+		return err
+	}
+	for _, cookie := range client.Client.Jar.Cookies(serviceURL) {
+		if cookie.Name == ".ASPXAUTH" {
+			client.Headers["Authorization"] = "Bearer " + cookie.Value
+		}
+	}
+	if client.Headers["Authorization"] == "" {
+		return fmt.Errorf("Failed to login as %s", vi.user)
+	}
+
+	vi.vaultClient = client
+	return nil
+}
+
+// getPassword returns password of unpw authentication
+func (vi *vaultInjector) getPassword() (string, error) {
+	if vi.password != "" {
+		return vi.password, nil
+	}
+	if vi.passwordFile != "" {
+		content, err := ioutil.ReadFile(vi.passwordFile)
+		if err != nil {
+			return "", fmt.Errorf("Error reading password file %s: %s", vi.passwordFile, err)
+		}
+		return strings.TrimSpace(string(content)), nil
+	}
+	return "", nil
+}
+
+// getOauthToken returns OAuth2 access token of oauth authentication. Token file is read on every authentication
+// so that token rotated in mounted Kubernetes secret is picked up in watch mode.
+func (vi *vaultInjector) getOauthToken() (string, error) {
+	if vi.token != "" {
+		return vi.token, nil
+	}
+	if vi.tokenFile == "" {
+		return "", fmt.Errorf("No OAuth token provided: set -token, VAULT_TOKEN or -token-file")
+	}
+	content, err := ioutil.ReadFile(vi.tokenFile)
+	if err != nil {
+		return "", fmt.Errorf("No OAuth token provided in -token or VAULT_TOKEN, and error reading token file: %s", err)
+	}
+	token := strings.TrimSpace(string(content))
+	if token == "" {
+		return "", fmt.Errorf("No OAuth token provided in -token or VAULT_TOKEN, and token file %s is empty", vi.tokenFile)
+	}
+	return token, nil
+}
+
+// Resolve checks out secret text or account password referenced by vault object.
+// Lookups failing with transient errors are retried. It is safe for concurrent use.
+func (b *centrifyBackend) Resolve(v vaultObject) ([]byte, error) {
+	// RestClient records response headers of every call, so each lookup works on its own copy
+	client := *b.client
+	var content string
+	var err error
+	switch v.resourceType {
+	case "secret":
+		err = b.retry.do("Checkout of "+v.envName, func() (err error) {
+			content, err = checkoutSecret(&client, v)
+			return err
+		})
+		if err == nil && content != "" {
+			logger.Printf("Checked out secret for %s\\%s\n", v.parentPath, v.secretName)
+		}
+	case "system", "database", "domain":
+		err = b.retry.do("Checkout of "+v.envName, func() (err error) {
+			content, err = checkoutPassword(&client, v)
+			return err
+		})
+		if err == nil && content != "" {
+			logger.Printf("Checked out password for %s/%s\n", v.resourceName, v.secretName)
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported resource type %s", v.resourceType)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return []byte(content), nil
+}
+
+func checkoutSecret(client *restapi.RestClient, v vaultObject) (string, error) {
+	secret := platform.NewSecret(client)
+	secret.Name = v.secretName
+	secret.SecretName = v.secretName
+	secret.ParentPath = v.parentPath
+	result, err := secret.Query()
+	if err != nil {
+		return "", fmt.Errorf("Error retrieving secret object: %w", err)
+	}
+	//fmt.Printf("Secret query result: %+v\n", result)
+	secret.ID = result["ID"].(string)
+	if result["FolderId"] != nil {
+		secret.FolderID = result["FolderId"].(string)
+	}
+	secrettext, err := secret.CheckoutSecret()
+	if err != nil {
+		return "", fmt.Errorf("Error retrieving secret content for %s: %w", secret.Name, err)
+	}
+
+	return secrettext, nil
+}
+
+func checkoutPassword(client *restapi.RestClient, v vaultObject) (string, error) {
+	// Handle account in system, database and domain
+	resourceID := ""
+	// Get resource ID
+	switch v.resourceType {
+	case "system":
+		resource := platform.NewSystem(client)
+		resource.Name = v.resourceName
+		result, err := resource.Query()
+		if err != nil {
+			return "", fmt.Errorf("Error retrieving system object: %w", err)
+		}
+		resource.ID = result["ID"].(string)
+		resourceID = resource.ID
+	case "database":
+		resource := platform.NewDatabase(client)
+		resource.Name = v.resourceName
+		result, err := resource.Query()
+		if err != nil {
+			return "", fmt.Errorf("Error retrieving database object: %w", err)
+		}
+		resource.ID = result["ID"].(string)
+		resourceID = resource.ID
+	case "domain":
+		resource := platform.NewDomain(client)
+		resource.Name = v.resourceName
+		result, err := resource.Query()
+		if err != nil {
+			return "", fmt.Errorf("Error retrieving domain object: %w", err)
+		}
+		resource.ID = result["ID"].(string)
+		resourceID = resource.ID
+	}
+
+	if resourceID == "" {
+		return "", nil
+	}
+
+	// Get account ID
+	acct := platform.NewAccount(client)
+	acct.User = v.secretName
+	switch v.resourceType {
+	case "system":
+		acct.Host = resourceID
+	case "database":
+		acct.DatabaseID = resourceID
+	case "domain":
+		acct.DomainID = resourceID
+	}
+	acctresult, err := acct.Query()
+	if err != nil {
+		return "", fmt.Errorf("Error retrieving account object: %w", err)
+	}
+	acct.ID = acctresult["ID"].(string)
+
+	// Checkout password
+	pw, err := acct.CheckoutPassword(false)
+	if err != nil {
+		return "", fmt.Errorf("Error checkout credential for %s: %w", acct.User, err)
+	}
+
+	return pw, nil
+}
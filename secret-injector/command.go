@@ -2,77 +2,138 @@ package main
 
 import (
 	"flag"
-	"fmt"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
-// getCmdParms parse command line argument
-func (c *vaultInjector) getCmdParms() {
+// getCmdParms parse command line argument, defining flags in fs. Options not given as argument default to env.
+func (c *vaultInjector) getCmdParms(fs *flag.FlagSet, args []string) {
 	// Common arguments
-	authTypePtr := flag.String("auth", "dmc", "Authentication type <oauth|unpw|dmc>")
-	urlPtr := flag.String("url", "", "Centrify tenant URL (Required)")
-	skipCertPtr := flag.Bool("skipcert", false, "Ignore certification verification")
+	authTypePtr := fs.String("auth", envOrDefault("VAULT_AUTHTYPE", "dmc"), "Authentication type <oauth|unpw|dmc|k8s|file>. Defaults to VAULT_AUTHTYPE env if set")
+	urlPtr := fs.String("url", "", "Centrify tenant URL (Required)")
+	skipCertPtr := fs.Bool("skipcert", false, "Ignore certification verification")
 
 	// Other arguments
-	appIDPtr := flag.String("appid", "", "OAuth application ID. Required if auth = oauth")
-	scopePtr := flag.String("scope", "", "OAuth or DMC scope definition. Required if auth = oauth or dmc")
-	tokenPtr := flag.String("token", "", "OAuth token. Optional if auth = oauth or dmc")
-	usernamePtr := flag.String("user", "", "Authorized user to login to tenant. Required if auth = unpw. Optional if auth = oauth")
-	passwordPtr := flag.String("password", "", "User password. You will be prompted to enter password if this isn't provided")
-	//codePtr := flag.String("code", "", "Enrollment code")
-
-	flag.Usage = func() {
-		fmt.Printf("Usage: centrify-secret-injector -auth dmc -url https://tenant.my.centrify.net -scope scope \n")
-		flag.PrintDefaults()
+	appIDPtr := fs.String("appid", "", "OAuth application ID. Required if auth = oauth")
+	scopePtr := fs.String("scope", "", "OAuth or DMC scope definition. Required if auth = oauth or dmc")
+	tokenPtr := fs.String("token", "", "OAuth token. Optional if auth = oauth or dmc. Takes precedence over VAULT_TOKEN env and token file")
+	tokenFilePtr := fs.String("token-file", envOrDefault("VAULT_TOKEN_FILE", defaultTokenFile), "File containing OAuth token. Used if auth = oauth and neither -token nor VAULT_TOKEN env is set. Defaults to VAULT_TOKEN_FILE env")
+	usernamePtr := fs.String("user", os.Getenv("VAULT_USER"), "Authorized user to login to tenant. Required if auth = unpw. Optional if auth = oauth. Defaults to VAULT_USER env")
+	passwordPtr := fs.String("password", "", "User password. If this isn't provided, it is read from VAULT_PASSWORD env or password file. You will be prompted to enter password if none of them is set")
+	passwordFilePtr := fs.String("password-file", os.Getenv("VAULT_PASSWORD_FILE"), "File containing user password. Defaults to VAULT_PASSWORD_FILE env")
+	saTokenFilePtr := fs.String("sa-token-file", envOrDefault("VAULT_SA_TOKEN_FILE", defaultSATokenFile), "File containing projected ServiceAccount token of the pod. Used if auth = k8s. Defaults to VAULT_SA_TOKEN_FILE env")
+	tokenEndpointPtr := fs.String("token-endpoint", os.Getenv("VAULT_TOKEN_ENDPOINT"), "Token endpoint that ServiceAccount token is exchanged at for an access token. Used if auth = k8s. Defaults to VAULT_TOKEN_ENDPOINT env, or OAuth2 token endpoint of appid")
+	//codePtr := fs.String("code", "", "Enrollment code")
+	fixturePtr := fs.String("fixture", os.Getenv("VAULT_FIXTURE_FILE"), "YAML or JSON file that secrets are served from instead of Centrify tenant. Required if auth = file. Defaults to VAULT_FIXTURE_FILE env")
+	secretsDirPtr := fs.String("secrets-dir", secretsFilesPath, "Directory that secret files are written to")
+	fileModePtr := fs.String("file-mode", envOrDefault("VAULT_FILE_MODE", defaultFileMode), "Permission of secret files in octal. Can be overridden per secret with \"?mode=\" option. Defaults to VAULT_FILE_MODE env")
+	fileUIDPtr := fs.Int("file-uid", envIntOrDefault("VAULT_FILE_UID", -1), "Owner of secret files. -1 leaves it unchanged. Can be overridden per secret with \"?uid=\" option. Defaults to VAULT_FILE_UID env")
+	fileGIDPtr := fs.Int("file-gid", envIntOrDefault("VAULT_FILE_GID", -1), "Group of secret files. -1 leaves it unchanged. Can be overridden per secret with \"?gid=\" option. Defaults to VAULT_FILE_GID env")
+	workersPtr := fs.Int("workers", envIntOrDefault("VAULT_WORKERS", defaultWorkers), "Number of secrets retrieved concurrently. Defaults to VAULT_WORKERS env")
+	outputPtr := fs.String("output", os.Getenv("VAULT_OUTPUT"), "Comma separated formats of files that aggregate all secrets <dotenv|json|yaml>, each optionally followed by \":file name\". Defaults to VAULT_OUTPUT env")
+	strictPtr := fs.Bool("strict", envBoolOrDefault("VAULT_STRICT", true), "Fail if any secret reference can't be parsed or resolves to an empty secret, instead of skipping it. Defaults to VAULT_STRICT env")
+	reportPtr := fs.String("report", os.Getenv("VAULT_REPORT"), "Print injection report to stdout in this format <json> after every run, and other messages to stderr. Defaults to VAULT_REPORT env")
+	watchPtr := fs.Duration("watch", envDurationOrDefault("VAULT_WATCH_INTERVAL", 0), "Keep running and refresh secrets on this interval and on SIGHUP, for example 5m. Secrets are retrieved only once if it is 0. Defaults to VAULT_WATCH_INTERVAL env")
+
+	// Retry policy for calls to tenant
+	retryAttemptsPtr := fs.Int("retry-attempts", envIntOrDefault("VAULT_RETRY_ATTEMPTS", defaultRetryAttempts), "Maximum number of attempts of authentication and each secret lookup. Defaults to VAULT_RETRY_ATTEMPTS env")
+	retryBackoffPtr := fs.Duration("retry-backoff", envDurationOrDefault("VAULT_RETRY_BACKOFF", defaultRetryBackoff), "Wait time before first retry, doubled for every further retry. Defaults to VAULT_RETRY_BACKOFF env")
+	retryMaxBackoffPtr := fs.Duration("retry-max-backoff", envDurationOrDefault("VAULT_RETRY_MAX_BACKOFF", defaultRetryMaxBackoff), "Maximum wait time between retries. Defaults to VAULT_RETRY_MAX_BACKOFF env")
+	retryJitterPtr := fs.Float64("retry-jitter", envFloatOrDefault("VAULT_RETRY_JITTER", defaultRetryJitter), "Fraction of wait time that is randomly added or subtracted. Defaults to VAULT_RETRY_JITTER env")
+	retryDeadlinePtr := fs.Duration("retry-deadline", envDurationOrDefault("VAULT_RETRY_DEADLINE", defaultRetryDeadline), "Overall time limit for all attempts of one call. Defaults to VAULT_RETRY_DEADLINE env")
+	requestTimeoutPtr := fs.Duration("request-timeout", envDurationOrDefault("VAULT_REQUEST_TIMEOUT", defaultRequestTimeout), "Time limit of a single request to tenant. Defaults to VAULT_REQUEST_TIMEOUT env")
+
+	// Hands environment over to injector running as systemd service in sidecar image of "dmc" authentication
+	dumpEnvPtr := fs.String("dump-env", "", "Write environment variables read by injector to this file and exit. Injector loads them from the file named by "+envFileEnv+" env")
+
+	fs.Usage = func() {
+		logger.Printf("Usage: centrify-secret-injector -auth dmc -url https://tenant.my.centrify.net -scope scope \n")
+		fs.PrintDefaults()
 	}
 
-	flag.Parse()
+	fs.Parse(args)
+
+	if *dumpEnvPtr != "" {
+		if err := dumpEnv(*dumpEnvPtr); err != nil {
+			logger.Printf("%v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
 
 	// Verify command argument length
 	if len(os.Args) < 1 {
-		flag.Usage()
+		fs.Usage()
 		os.Exit(1)
 	}
 
 	// Verify authTypePtr value
-	authChoices := map[string]bool{"oauth": true, "unpw": true, "dmc": true}
+	authChoices := map[string]bool{"oauth": true, "unpw": true, "dmc": true, "k8s": true, "file": true}
 	if _, validChoice := authChoices[*authTypePtr]; !validChoice {
-		fmt.Printf("Incorrect auth parameter")
-		flag.Usage()
+		logger.Printf("Incorrect auth parameter")
+		fs.Usage()
 		os.Exit(1)
 	}
 	// Check required argument that do not have default value
-	if *urlPtr == "" {
-		fmt.Printf("Missing url parameter")
-		flag.Usage()
+	if *urlPtr == "" && *authTypePtr != "file" {
+		logger.Printf("Missing url parameter")
+		fs.Usage()
 		os.Exit(1)
 	}
 
 	switch *authTypePtr {
 	case "oauth":
 		if *appIDPtr == "" || *scopePtr == "" {
-			fmt.Printf("Missing appid and scope parameter")
-			flag.Usage()
-			os.Exit(1)
-		}
-		// Either token or username must be provided
-		if *tokenPtr == "" && *usernamePtr == "" {
-			fmt.Printf("Missing token or user parameter")
-			flag.Usage()
+			logger.Printf("Missing appid and scope parameter")
+			fs.Usage()
 			os.Exit(1)
 		}
 	case "unpw":
 		if *urlPtr == "" || *usernamePtr == "" {
-			fmt.Printf("Missing url and user parameter")
-			flag.Usage()
+			logger.Printf("Missing url and user parameter")
+			fs.Usage()
 			os.Exit(1)
 		}
 	case "dmc":
 		if *tokenPtr == "" && *scopePtr == "" {
-			fmt.Printf("Missing token or scope parameter")
-			flag.Usage()
+			logger.Printf("Missing token or scope parameter")
+			fs.Usage()
+			os.Exit(1)
+		}
+	case "k8s":
+		if *appIDPtr == "" && *tokenEndpointPtr == "" {
+			logger.Printf("Missing appid or token-endpoint parameter")
+			fs.Usage()
 			os.Exit(1)
 		}
+	case "file":
+		if *fixturePtr == "" {
+			logger.Printf("Missing fixture parameter")
+			fs.Usage()
+			os.Exit(1)
+		}
+	}
+
+	if *reportPtr != "" && *reportPtr != reportJSON {
+		logger.Printf("Incorrect report parameter")
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	fileMode, err := parseFileMode(*fileModePtr)
+	if err != nil {
+		logger.Printf("Incorrect file-mode parameter")
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	outputs, err := parseOutputs(*outputPtr)
+	if err != nil {
+		logger.Printf("Incorrect output parameter: %v", err)
+		fs.Usage()
+		os.Exit(1)
 	}
 
 	// Assign argument values to struct
@@ -83,6 +144,86 @@ func (c *vaultInjector) getCmdParms() {
 	c.token = *tokenPtr
 	c.user = *usernamePtr
 	c.password = *passwordPtr
+	c.passwordFile = *passwordFilePtr
+	c.tokenFile = *tokenFilePtr
+	c.saTokenFile = *saTokenFilePtr
+	c.tokenEndpoint = *tokenEndpointPtr
 	c.skipcert = *skipCertPtr
+	c.fixtureFile = *fixturePtr
+	c.secretsDir = *secretsDirPtr
+	c.fileMode = fileMode
+	c.fileUID = *fileUIDPtr
+	c.fileGID = *fileGIDPtr
+	c.workers = *workersPtr
+	c.outputs = outputs
+	c.strict = *strictPtr
+	c.reportFormat = *reportPtr
+	c.watchInterval = *watchPtr
+	c.retry = retryPolicy{
+		maxAttempts:    *retryAttemptsPtr,
+		initialBackoff: *retryBackoffPtr,
+		maxBackoff:     *retryMaxBackoffPtr,
+		jitter:         *retryJitterPtr,
+		deadline:       *retryDeadlinePtr,
+		requestTimeout: *requestTimeoutPtr,
+	}
 	//c.code = *codePtr
 }
+
+// envOrDefault returns value of environment variable or the default if it is not set
+func envOrDefault(name string, defaultValue string) string {
+	if value, ok := os.LookupEnv(name); ok && value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+// envIntOrDefault returns integer value of environment variable or the default if it is not set or invalid
+func envIntOrDefault(name string, defaultValue int) int {
+	if value := os.Getenv(name); value != "" {
+		n, err := strconv.Atoi(value)
+		if err == nil {
+			return n
+		}
+		logger.Printf("Ignoring invalid %s value %s\n", name, value)
+	}
+	return defaultValue
+}
+
+// envBoolOrDefault returns boolean value of environment variable or the default if it is not set or invalid
+func envBoolOrDefault(name string, defaultValue bool) bool {
+	switch value := strings.ToLower(os.Getenv(name)); value {
+	case "":
+	case "y", "yes", "true", "on", "1":
+		return true
+	case "n", "no", "false", "off", "0":
+		return false
+	default:
+		logger.Printf("Ignoring invalid %s value %s\n", name, value)
+	}
+	return defaultValue
+}
+
+// envFloatOrDefault returns float value of environment variable or the default if it is not set or invalid
+func envFloatOrDefault(name string, defaultValue float64) float64 {
+	if value := os.Getenv(name); value != "" {
+		f, err := strconv.ParseFloat(value, 64)
+		if err == nil {
+			return f
+		}
+		logger.Printf("Ignoring invalid %s value %s\n", name, value)
+	}
+	return defaultValue
+}
+
+// envDurationOrDefault returns duration value of environment variable or the default if it is not set or invalid
+func envDurationOrDefault(name string, defaultValue time.Duration) time.Duration {
+	if value := os.Getenv(name); value != "" {
+		d, err := time.ParseDuration(value)
+		if err == nil {
+			return d
+		}
+		logger.Printf("Ignoring invalid %s value %s\n", name, value)
+	}
+	return defaultValue
+}
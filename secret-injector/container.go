@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+)
+
+const (
+	// containerSecretsEnvPrefix prefixes env vars listing secrets of a container, for example VAULT_CONTAINER_SECRETS_app=DB_PASSWORD,API_KEY
+	containerSecretsEnvPrefix = "VAULT_CONTAINER_SECRETS_"
+	// containersDir holds a subdirectory for each container that receives a subset of secrets.
+	// Webhook mounts the subdirectory instead of the whole secrets directory into the container.
+	containersDir = ".containers"
+)
+
+// containerSubset is a subset of secrets written to the subdirectory of a container
+type containerSubset struct {
+	dir     string // relative to secrets directory
+	secrets []resolvedSecret
+}
+
+// containerDir returns subdirectory of container relative to secrets directory
+func containerDir(container string) string {
+	return filepath.Join(containersDir, container)
+}
+
+// containerSubsets selects secrets of each container from written secrets, in order of container name
+func (vi *vaultInjector) containerSubsets(written []resolvedSecret) ([]containerSubset, error) {
+	var containers []string
+	for container := range vi.containerSecrets {
+		containers = append(containers, container)
+	}
+	sort.Strings(containers)
+
+	var subsets []containerSubset
+	for _, container := range containers {
+		subset := containerSubset{dir: containerDir(container)}
+		for _, name := range vi.containerSecrets[container] {
+			found := false
+			for _, r := range written {
+				if r.vo.envName == name {
+					subset.secrets = append(subset.secrets, r)
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("Secret %s of container %s is not defined or is empty", name, container)
+			}
+		}
+		subsets = append(subsets, subset)
+	}
+	return subsets, nil
+}
+
+// changedIn returns names of changed files that are directly in dir, given paths relative to secrets directory
+func changedIn(dir string, changed []string) []string {
+	if dir == "" {
+		dir = "."
+	}
+	var names []string
+	for _, c := range changed {
+		if filepath.Dir(c) == dir {
+			names = append(names, filepath.Base(c))
+		}
+	}
+	return names
+}
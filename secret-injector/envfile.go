@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// envFileEnv names the file that environment of injector is loaded from. The sidecar image of "dmc" authentication
+// runs injector as systemd service, which doesn't see environment of the container, so centrifycc-enroll.sh hands
+// it over in this file.
+const envFileEnv = "VAULT_ENV_FILE"
+
+// dumpedEnv tells whether environment variable is read by injector and must be handed over to it
+func dumpedEnv(name string, value string) bool {
+	switch name {
+	case envFileEnv, "VAULT_ENROLLMENTCODE":
+		// Enrollment code is only used by cenroll
+		return false
+	}
+	_, _, isRef := splitScheme(value)
+	return isRef || strings.HasPrefix(name, "VAULT_")
+}
+
+// dumpEnv writes environment variables read by injector, including secret references, templates and options,
+// to file as a JSON object. Unlike an EnvironmentFile of systemd, it keeps multi-line values such as templates.
+func dumpEnv(file string) error {
+	env := make(map[string]string)
+	for _, e := range os.Environ() {
+		split := strings.SplitN(e, "=", 2)
+		if len(split) == 2 && dumpedEnv(split[0], split[1]) {
+			env[split[0]] = split[1]
+		}
+	}
+	content, err := json.MarshalIndent(env, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(file, append(content, '\n'), 0600); err != nil {
+		return fmt.Errorf("Error writing env file %s: %v", file, err)
+	}
+	return nil
+}
+
+// loadEnv sets environment variables from file written by dumpEnv. Variables that are already set are kept.
+func loadEnv(file string) error {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("Error reading env file %s: %v", file, err)
+	}
+	env := make(map[string]string)
+	if err := json.Unmarshal(content, &env); err != nil {
+		return fmt.Errorf("Error parsing env file %s: %v", file, err)
+	}
+	for name, value := range env {
+		if _, ok := os.LookupEnv(name); ok {
+			continue
+		}
+		if err := os.Setenv(name, value); err != nil {
+			return fmt.Errorf("Error setting %s from env file %s: %v", name, file, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// extractField returns value of a single field of structured secret such as
+// {"user": "sa", "password": "..."} in JSON, "password: ..." in YAML or "PASSWORD=..." in dotenv format.
+// Nested fields of JSON and YAML secrets are selected with dots, for example "db.password".
+func extractField(content []byte, field string) ([]byte, error) {
+	if doc, err := decodeJSON(content); err == nil {
+		if _, ok := doc.(map[string]interface{}); ok {
+			return lookupField(doc, field, json.Marshal)
+		}
+	}
+	var doc interface{}
+	if err := yaml.Unmarshal(content, &doc); err == nil {
+		if _, ok := doc.(map[interface{}]interface{}); ok {
+			return lookupField(doc, field, yaml.Marshal)
+		}
+	}
+	if env, ok := parseDotenv(content); ok {
+		value, ok := env[field]
+		if !ok {
+			return nil, fieldNotFound(field, env)
+		}
+		return []byte(value), nil
+	}
+	return nil, fmt.Errorf("field %s can't be extracted since secret is not JSON, YAML or dotenv", field)
+}
+
+// decodeJSON decodes JSON document keeping numbers as they are written, so that large ids don't lose precision
+func decodeJSON(content []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(content))
+	dec.UseNumber()
+	var doc interface{}
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("data after JSON document")
+	}
+	return doc, nil
+}
+
+// lookupField returns value of field in decoded JSON or YAML document. Values that are not scalar are encoded with marshal.
+func lookupField(doc interface{}, field string, marshal func(interface{}) ([]byte, error)) ([]byte, error) {
+	value, ok := fieldValue(doc, field)
+	if !ok {
+		// Field name may itself contain dots
+		value = doc
+		for _, key := range strings.Split(field, ".") {
+			if value, ok = fieldValue(value, key); !ok {
+				return nil, fieldNotFound(field, doc)
+			}
+		}
+	}
+	switch v := value.(type) {
+	case string:
+		return []byte(v), nil
+	case map[string]interface{}, map[interface{}]interface{}, []interface{}:
+		return marshal(v)
+	case nil:
+		return nil, fmt.Errorf("field %s is empty", field)
+	case float64:
+		// YAML floats are written without exponent
+		return []byte(strconv.FormatFloat(v, 'f', -1, 64)), nil
+	default:
+		// json.Number is written verbatim
+		return []byte(fmt.Sprint(v)), nil
+	}
+}
+
+// fieldValue returns value of key if doc is a JSON or YAML mapping
+func fieldValue(doc interface{}, key string) (interface{}, bool) {
+	switch m := doc.(type) {
+	case map[string]interface{}:
+		value, ok := m[key]
+		return value, ok
+	case map[interface{}]interface{}:
+		value, ok := m[key]
+		return value, ok
+	}
+	return nil, false
+}
+
+// fieldNotFound returns error listing top level field names of doc, but not their values
+func fieldNotFound(field string, doc interface{}) error {
+	var names []string
+	switch m := doc.(type) {
+	case map[string]interface{}:
+		for k := range m {
+			names = append(names, k)
+		}
+	case map[interface{}]interface{}:
+		for k := range m {
+			names = append(names, fmt.Sprint(k))
+		}
+	case map[string]string:
+		for k := range m {
+			names = append(names, k)
+		}
+	}
+	sort.Strings(names)
+	return fmt.Errorf("field %s not found in secret, available fields: %s", field, strings.Join(names, ", "))
+}
+
+// parseDotenv parses KEY=VALUE lines. Empty lines, comments and "export" prefix are allowed
+// and values may be quoted. It fails unless every other line is KEY=VALUE.
+func parseDotenv(content []byte) (map[string]string, bool) {
+	env := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		split := strings.SplitN(line, "=", 2)
+		if len(split) != 2 {
+			return nil, false
+		}
+		key := strings.TrimSpace(split[0])
+		if key == "" || strings.ContainsAny(key, " \t") {
+			return nil, false
+		}
+		value := strings.TrimSpace(split[1])
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		env[key] = value
+	}
+	if scanner.Err() != nil || len(env) == 0 {
+		return nil, false
+	}
+	return env, true
+}
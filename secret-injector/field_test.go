@@ -0,0 +1,211 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExtractField(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		field   string
+		want    string
+		err     string
+	}{
+		{
+			name:    "json",
+			content: `{"user": "sa", "password": "dbpass"}`,
+			field:   "password",
+			want:    "dbpass",
+		},
+		{
+			name:    "json nested",
+			content: `{"db": {"primary": {"password": "dbpass"}}}`,
+			field:   "db.primary.password",
+			want:    "dbpass",
+		},
+		{
+			name:    "json field name with dots",
+			content: `{"db.password": "dotted", "db": {"password": "nested"}}`,
+			field:   "db.password",
+			want:    "dotted",
+		},
+		{
+			name:    "json large integer",
+			content: `{"id": 12345678901234567890}`,
+			field:   "id",
+			want:    "12345678901234567890",
+		},
+		{
+			name:    "json integer not in scientific notation",
+			content: `{"port": 1000000}`,
+			field:   "port",
+			want:    "1000000",
+		},
+		{
+			name:    "json number as written",
+			content: `{"ratio": 1.50, "exp": 1e3}`,
+			field:   "ratio",
+			want:    "1.50",
+		},
+		{
+			name:    "json boolean",
+			content: `{"enabled": true}`,
+			field:   "enabled",
+			want:    "true",
+		},
+		{
+			name:    "json object is encoded",
+			content: `{"db": {"port": 5432, "user": "sa"}}`,
+			field:   "db",
+			want:    `{"port":5432,"user":"sa"}`,
+		},
+		{
+			name:    "json null",
+			content: `{"password": null}`,
+			field:   "password",
+			err:     "field password is empty",
+		},
+		{
+			name:    "json missing field",
+			content: `{"user": "sa", "password": "dbpass"}`,
+			field:   "pass",
+			err:     "field pass not found in secret, available fields: password, user",
+		},
+		{
+			name:    "json missing nested field",
+			content: `{"db": {"password": "dbpass"}}`,
+			field:   "db.user",
+			err:     "field db.user not found in secret, available fields: db",
+		},
+		{
+			name:    "yaml",
+			content: "user: sa\npassword: dbpass\n",
+			field:   "password",
+			want:    "dbpass",
+		},
+		{
+			name:    "yaml nested",
+			content: "db:\n  primary:\n    password: dbpass\n",
+			field:   "db.primary.password",
+			want:    "dbpass",
+		},
+		{
+			name:    "yaml numbers and booleans",
+			content: "port: 1000000\nratio: 2500000.5\nenabled: yes\n",
+			field:   "port",
+			want:    "1000000",
+		},
+		{
+			name:    "yaml float without exponent",
+			content: "port: 1000000\nratio: 2500000.5\n",
+			field:   "ratio",
+			want:    "2500000.5",
+		},
+		{
+			name:    "yaml boolean",
+			content: "enabled: true\n",
+			field:   "enabled",
+			want:    "true",
+		},
+		{
+			name:    "yaml mapping is encoded",
+			content: "db:\n  user: sa\n",
+			field:   "db",
+			want:    "user: sa\n",
+		},
+		{
+			name:    "yaml missing field",
+			content: "user: sa\n",
+			field:   "password",
+			err:     "field password not found in secret, available fields: user",
+		},
+		{
+			name:    "dotenv",
+			content: "# database\nexport DB_USER=sa\nDB_PASSWORD=\"db pass\"\n",
+			field:   "DB_PASSWORD",
+			want:    "db pass",
+		},
+		{
+			name:    "dotenv missing field",
+			content: "DB_USER=sa\nDB_PASSWORD=dbpass\n",
+			field:   "DB_HOST",
+			err:     "field DB_HOST not found in secret, available fields: DB_PASSWORD, DB_USER",
+		},
+		{
+			name:    "plain text",
+			content: "just a password",
+			field:   "password",
+			err:     "field password can't be extracted since secret is not JSON, YAML or dotenv",
+		},
+		{
+			name:    "json array",
+			content: `["a", "b"]`,
+			field:   "0",
+			err:     "can't be extracted",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := extractField([]byte(tt.content), tt.field)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("extractField() = %q, %v, want error %q", got, err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("extractField() error = %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("extractField() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseDotenv(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    map[string]string
+	}{
+		{
+			name:    "quotes, comments and export",
+			content: "# comment\n\nexport A=1\nB = 'two words'\nC=\"x=y\"\nD=\n",
+			want:    map[string]string{"A": "1", "B": "two words", "C": "x=y", "D": ""},
+		},
+		{
+			name:    "unbalanced quote is kept",
+			content: "A=\"value\n",
+			want:    map[string]string{"A": `"value`},
+		},
+		{
+			name:    "line without equals sign",
+			content: "A=1\nnot dotenv\n",
+		},
+		{
+			name:    "key with space",
+			content: "MY KEY=1\n",
+		},
+		{
+			name:    "only comments",
+			content: "# nothing\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseDotenv([]byte(tt.content))
+			if ok != (tt.want != nil) {
+				t.Fatalf("parseDotenv() ok = %v, want %v", ok, tt.want != nil)
+			}
+			if ok && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseDotenv() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
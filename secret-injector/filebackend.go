@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// vaultFixture is the content of a fixture file served by fileBackend. YAML and JSON are both accepted.
+//
+//	secrets:
+//	  folder1/folder2/testsecret2: "secret text"
+//	system:
+//	  "MySQL (Demo Lab)":
+//	    dbadmin: "password"
+type vaultFixture struct {
+	Secrets  map[string]string            `yaml:"secrets"`
+	System   map[string]map[string]string `yaml:"system"`
+	Database map[string]map[string]string `yaml:"database"`
+	Domain   map[string]map[string]string `yaml:"domain"`
+}
+
+// fileBackend resolves vault objects from a local fixture file so that secret injection can run without Centrify tenant
+type fileBackend struct {
+	fixture vaultFixture
+}
+
+// newFileBackend loads fixture file
+func newFileBackend(fixtureFile string) (SecretBackend, error) {
+	if fixtureFile == "" {
+		return nil, fmt.Errorf("Fixture file is required if auth = file")
+	}
+	content, err := ioutil.ReadFile(fixtureFile)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading fixture file %s: %s", fixtureFile, err)
+	}
+
+	b := &fileBackend{}
+	if err := yaml.UnmarshalStrict(content, &b.fixture); err != nil {
+		return nil, fmt.Errorf("Error parsing fixture file %s: %s", fixtureFile, err)
+	}
+	return b, nil
+}
+
+// Resolve looks up secret text or account password referenced by vault object in fixture
+func (b *fileBackend) Resolve(v vaultObject) ([]byte, error) {
+	var accounts map[string]map[string]string
+	switch v.resourceType {
+	case "secret":
+		// Fixture uses the same "/" separated path as vault://secret/ reference
+		secretPath := v.secretName
+		if v.parentPath != "" {
+			secretPath = strings.Replace(v.parentPath, "\\", "/", -1) + "/" + v.secretName
+		}
+		text, ok := b.fixture.Secrets[secretPath]
+		if !ok {
+			return nil, fmt.Errorf("Error retrieving secret object: %s not found in fixture", secretPath)
+		}
+		logger.Printf("Checked out secret for %s\\%s\n", v.parentPath, v.secretName)
+		return []byte(text), nil
+	case "system":
+		accounts = b.fixture.System
+	case "database":
+		accounts = b.fixture.Database
+	case "domain":
+		accounts = b.fixture.Domain
+	default:
+		return nil, fmt.Errorf("Unsupported resource type %s", v.resourceType)
+	}
+
+	resource, ok := accounts[v.resourceName]
+	if !ok {
+		return nil, fmt.Errorf("Error retrieving %s object: %s not found in fixture", v.resourceType, v.resourceName)
+	}
+	pw, ok := resource[v.secretName]
+	if !ok {
+		return nil, fmt.Errorf("Error retrieving account object: %s/%s not found in fixture", v.resourceName, v.secretName)
+	}
+	logger.Printf("Checked out password for %s/%s\n", v.resourceName, v.secretName)
+	return []byte(pw), nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// completeMarkerFile is written to secret directory only after the full set of secret files is in place.
+	// It lists the secret files one per line, as "NAME" or "NAME=file name" if the file isn't named after its env var.
+	completeMarkerFile = ".complete"
+	defaultFileMode    = "0640"
+)
+
+// isUnchanged tells whether the file at path already has content and permission
+func isUnchanged(path string, content []byte, perm os.FileMode) bool {
+	info, err := os.Stat(path)
+	if err != nil || info.Mode().Perm() != perm {
+		return false
+	}
+	current, err := ioutil.ReadFile(path)
+	return err == nil && bytes.Equal(current, content)
+}
+
+// writeTempFile writes content to a temporary file next to path and returns its name.
+// uid or gid of -1 leaves ownership unchanged.
+func writeTempFile(path string, content []byte, perm os.FileMode, uid int, gid int) (string, error) {
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return "", err
+	}
+	// Restrict permission before any content is written
+	err = f.Chmod(perm)
+	if err == nil && (uid != -1 || gid != -1) {
+		err = f.Chown(uid, gid)
+	}
+	if err == nil {
+		_, err = f.Write(content)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// writeFileAtomic writes content to a temporary file then renames it to path, so that readers never see partial content
+func writeFileAtomic(path string, content []byte, perm os.FileMode) error {
+	tmpPath, err := writeTempFile(path, content, perm, -1, -1)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+// manifestEntry returns line of completion marker for secret file of vo. It is the name of the file, preceded by
+// the env var name and "=" if they differ, so that app launcher can inject the secret under the right name.
+func manifestEntry(vo vaultObject) string {
+	if vo.fileName == vo.envName {
+		return vo.fileName
+	}
+	return vo.envName + "=" + vo.fileName
+}
+
+// writeCompleteMarker writes completion marker listing secret files in dir, relative to secrets directory.
+// It is rewritten only if secret files changed or the marker doesn't exist yet.
+func (vi *vaultInjector) writeCompleteMarker(dir string, secrets []resolvedSecret, changed bool) error {
+	markerPath := filepath.Join(vi.secretsDir, dir, completeMarkerFile)
+	if _, err := os.Stat(markerPath); err == nil && !changed {
+		return nil
+	}
+	var content string
+	for _, r := range secrets {
+		content += manifestEntry(r.vo) + "\n"
+	}
+	return writeFileAtomic(markerPath, []byte(content), 0644)
+}
+
+// removeCompleteMarkers removes completion markers of directories in which some of changed files were replaced
+func (vi *vaultInjector) removeCompleteMarkers(changed []string) {
+	dirs := make(map[string]bool)
+	for _, f := range changed {
+		dirs[filepath.Dir(f)] = true
+	}
+	for dir := range dirs {
+		markerPath := filepath.Join(vi.secretsDir, dir, completeMarkerFile)
+		if err := os.Remove(markerPath); err != nil && !os.IsNotExist(err) {
+			logger.Printf("Error removing %s: %v\n", markerPath, err)
+		}
+	}
+}
+
+// partialWriteError is returned when some changed files were replaced before writing another one failed
+type partialWriteError struct {
+	pending []string // changed files that were not written, relative to secrets directory
+	err     error
+}
+
+func (e *partialWriteError) Error() string {
+	return fmt.Sprintf("%v, %d file(s) not written: %v", e.err, len(e.pending), e.pending)
+}
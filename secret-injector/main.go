@@ -1,25 +1,36 @@
 package main
 
 import (
+	"flag"
 	"fmt"
-	"io/ioutil"
+	"log"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
-	"github.com/marcozj/golang-sdk/dmc"
-	"github.com/marcozj/golang-sdk/oauth"
-	"github.com/marcozj/golang-sdk/platform"
 	"github.com/marcozj/golang-sdk/restapi"
+	"github.com/marcozj/k8s-secret-injection/internal/redact"
+	"github.com/marcozj/k8s-secret-injection/internal/rules"
 )
 
 const (
-	vaultPathPrex    = "vault://"
+	vaultScheme      = "vault"
+	schemeSeparator  = "://"
 	secretsFilesPath = "/centrify/secrets"
+	// defaultTokenFile is where webhook mounts Kubernetes secret containing OAuth token
+	defaultTokenFile = "/var/secrets/oauthtoken"
 )
 
+// logger prints progress messages. It prints to stderr in json report mode so that stdout only carries reports.
+var logger = log.New(os.Stdout, "", 0)
+
 // vaultInjector is data structure for injecting secret retrieved from vaults into environment variables
 type vaultInjector struct {
 	secrets     []vaultObject
+	backends    map[string]SecretBackend
 	vaultClient *restapi.RestClient
 	auth        string
 	url         string
@@ -29,90 +40,83 @@ type vaultInjector struct {
 	user        string
 	password    string
 	//code        string
-	skipcert bool
+	passwordFile string // file containing password for unpw authentication
+	tokenFile    string // file containing OAuth token, used if neither -token nor VAULT_TOKEN is set
+	saTokenFile  string // file containing projected ServiceAccount token for k8s authentication
+	skipcert     bool
+	fixtureFile  string       // fixture file served by file backend
+	secretsDir   string       // directory that secret files are written to
+	fileMode     os.FileMode  // default permission of secret files
+	fileUID      int          // default owner of secret files
+	fileGID      int          // default group of secret files
+	workers      int          // number of secrets retrieved concurrently
+	strict       bool         // fail on references that can't be parsed or resolve to empty secrets instead of skipping them
+	outputs      []outputFile // templates and aggregate outputs rendered from all secrets
+	// Env var names of secrets that are also written to a subdirectory for each container, see containerDir
+	containerSecrets map[string][]string
+	retry            retryPolicy
+	// Env vars that can't be parsed. They fail getSecrets in strict mode
+	invalid []resolvedSecret
+	// Format of injection report printed to stdout after every run. Nothing is printed if it is empty
+	reportFormat string
+	// Token endpoint that ServiceAccount token is exchanged at. Defaults to OAuth2 token endpoint of appid
+	tokenEndpoint string
+	// Refresh interval of watch mode. Secrets are retrieved only once if it is 0
+	watchInterval time.Duration
+	generation    int // number of change events emitted in watch mode
 }
 
 type vaultObject struct {
 	envName      string
+	scheme       string
 	resourceType string
 	resourceName string
 	parentPath   string
 	secretName   string
+	fileMode     os.FileMode // permission of secret file
+	uid          int         // owner of secret file. -1 leaves it unchanged
+	gid          int         // group of secret file. -1 leaves it unchanged
+	field        string      // field extracted from structured secret. Whole secret is used if it is empty
+	fileName     string      // name of secret file. Defaults to envName
 }
 
 func main() {
 	injector := &vaultInjector{}
-	injector.getCmdParms()
+	if file := os.Getenv(envFileEnv); file != "" {
+		if err := loadEnv(file); err != nil {
+			logger.Printf("%v\n", err)
+			os.Exit(1)
+		}
+	}
+	injector.getCmdParms(flag.CommandLine, os.Args[1:])
+	if injector.reportFormat == reportJSON {
+		logger.SetOutput(os.Stderr)
+	}
 	injector.parseEnv()
 	if len(injector.secrets) == 0 {
-		fmt.Println("Nothing to parse from env")
+		logger.Println("Nothing to parse from env")
 	} else {
 		//fmt.Printf("Parse env: %v\n", injector.secrets)
 	}
 
-	var err error
-	switch injector.auth {
-	case "oauth":
-		err = injector.getOauthRestClient()
-	case "dmc":
-		err = injector.getDMCRestClient()
+	if injector.watchInterval > 0 {
+		injector.watch()
+		return
 	}
 
+	err := injector.initBackends()
 	if err != nil {
-		fmt.Printf("Unable to get oauth rest client: %v\n", err)
+		logger.Printf("%v\n", err)
 		os.Exit(1)
 	}
 
-	err = injector.getSecrets()
+	_, err = injector.getSecrets()
 	if err != nil {
-		fmt.Printf("%v\n", err)
+		logger.Printf("%v\n", err)
 		os.Exit(1)
 	}
 }
 
-func (vi *vaultInjector) getOauthRestClient() error {
-	var err error
-
-	// If /var/secrets/oauthtoken exist, use its content instead
-	content, err := ioutil.ReadFile("/var/secrets/oauthtoken")
-	if string(content) != "" {
-		vi.token = string(content)
-	}
-	call := oauth.OauthClient{
-		Service:        vi.url,
-		AppID:          vi.appid,
-		Scope:          vi.scope,
-		SkipCertVerify: vi.skipcert,
-	}
-	token := oauth.TokenResponse{
-		AccessToken: vi.token,
-		//AccessToken: t,
-		TokenType: "Bearer",
-	}
-
-	vi.vaultClient, err = call.GetRestClient(&token)
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
-func (vi *vaultInjector) getDMCRestClient() error {
-	call := dmc.DMC{}
-	call.Service = vi.url
-	call.Scope = vi.scope
-	call.Token = vi.token
-	call.SkipCertVerify = vi.skipcert
-
-	var err error
-	vi.vaultClient, err = call.GetClient()
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
-
 func (vi *vaultInjector) parseEnv() {
 	// parse env vaue equals to format like this "vault://database/SQL-CENTRIFYSUITE/demo_sa"
 	// or "vault://secret/folder/folder/secretname" or "vault://secret/secretname"
@@ -121,10 +125,22 @@ func (vi *vaultInjector) parseEnv() {
 		name := split[0]
 		value := split[1]
 		var vo vaultObject
-		if strings.HasPrefix(value, vaultPathPrex) {
-			// Parse env whose value starts with "vault://"
+		if scheme, vaultPath, ok := splitScheme(value); ok {
+			// Parse env whose value starts with "vault://" or other registered scheme
 			vo.envName = name
-			vaultPath := strings.TrimPrefix(value, vaultPathPrex)
+			vo.fileName = name
+			vo.scheme = scheme
+			vo.fileMode = vi.fileMode
+			vo.uid = vi.fileUID
+			vo.gid = vi.fileGID
+			// Options such as "?mode=0400&uid=1000" follow the path, and "#field" comes last
+			vaultPath, fragment := splitFragment(vaultPath)
+			vaultPath, query := splitQuery(vaultPath)
+			vo.field = fragment
+			if err := vo.parseOptions(query); err != nil {
+				vi.rejectEnv(vo, err)
+				continue
+			}
 			credPath := strings.Split(vaultPath, "/")
 			//fmt.Printf("Processing %s\n", vaultPath)
 			splitLength := len(credPath)
@@ -150,9 +166,11 @@ func (vi *vaultInjector) parseEnv() {
 					if vo.secretName != "" {
 						// Not to be tricked by the case of "vault://secret/"
 						vi.secrets = append(vi.secrets, vo)
+						continue
 					}
 					//fmt.Printf("Parent path: %s\n", vo.parentPath)
 				}
+				vi.rejectEnv(vo, fmt.Errorf("%s must be %s://secret/<path name>/.../<secret name>", value, scheme))
 			case "system", "database", "domain":
 				// Handle vaulted account for system, database and domain
 				// Minimumlly must be at least "vault://system/systemname/accountname"
@@ -163,9 +181,36 @@ func (vi *vaultInjector) parseEnv() {
 				if vo.resourceName != "" && vo.secretName != "" {
 					// Not to be tricked by the case of "vault://system/systemname/"
 					vi.secrets = append(vi.secrets, vo)
+					continue
 				}
+				vi.rejectEnv(vo, fmt.Errorf("%s must be %s://%s/<%s name>/<account name>", value, scheme, vo.resourceType, vo.resourceType))
+			default:
+				vi.rejectEnv(vo, fmt.Errorf("%s refers to unknown resource type %q, must be system, database, domain or secret", value, vo.resourceType))
 			}
 
+		} else if strings.HasPrefix(name, containerSecretsEnvPrefix) {
+			// Parse comma separated names of secrets that a container receives
+			container := strings.TrimPrefix(name, containerSecretsEnvPrefix)
+			if err := rules.CheckFileName(container); err != nil {
+				vi.rejectEnv(vaultObject{envName: name}, err)
+				continue
+			}
+			if vi.containerSecrets == nil {
+				vi.containerSecrets = make(map[string][]string)
+			}
+			for _, s := range strings.Split(value, ",") {
+				if s = strings.TrimSpace(s); s != "" {
+					vi.containerSecrets[container] = append(vi.containerSecrets[container], s)
+				}
+			}
+		} else if strings.HasPrefix(name, templateEnvPrefix) {
+			// Parse template rendered into the file named by the rest of env name
+			t, err := parseTemplate(strings.TrimPrefix(name, templateEnvPrefix), value)
+			if err != nil {
+				vi.rejectEnv(vaultObject{envName: name}, err)
+				continue
+			}
+			vi.outputs = append(vi.outputs, t)
 		} else {
 			// Parse env that are for authentication purpose
 			switch name {
@@ -176,9 +221,18 @@ func (vi *vaultInjector) parseEnv() {
 			case "VAULT_SCOPE":
 				vi.scope = value
 			case "VAULT_TOKEN":
-				vi.token = value
+				// -token parameter takes precedence
+				if vi.token == "" {
+					vi.token = value
+				}
 			case "VAULT_AUTHTYPE":
 				vi.auth = value
+			case "VAULT_USER":
+				vi.user = value
+			case "VAULT_PASSWORD":
+				vi.password = value
+			case "VAULT_PASSWORD_FILE":
+				vi.passwordFile = value
 				//case "VAULT_ENROLLMENTCODE":
 				//	vi.code = value
 			}
@@ -186,111 +240,213 @@ func (vi *vaultInjector) parseEnv() {
 	}
 }
 
-func (vi *vaultInjector) getSecrets() error {
-	for _, v := range vi.secrets {
-		if v.resourceType == "secret" {
-			// Handle secret
-			secret := platform.NewSecret(vi.vaultClient)
-			secret.Name = v.secretName
-			secret.SecretName = v.secretName
-			secret.ParentPath = v.parentPath
-			result, err := secret.Query()
-			if err != nil {
-				return fmt.Errorf("Error retrieving secret object: %s", err)
-			}
-			//fmt.Printf("Secret query result: %+v\n", result)
-			secret.ID = result["ID"].(string)
-			if result["FolderId"] != nil {
-				secret.FolderID = result["FolderId"].(string)
-			}
-			secrettext, err := secret.CheckoutSecret()
-			if err != nil {
-				return fmt.Errorf("Error retrieving secret content for %s: %s", secret.Name, err)
-			}
+// rejectEnv records env var of vo that can't be parsed. It fails secret injection in strict mode and is skipped otherwise.
+func (vi *vaultInjector) rejectEnv(vo vaultObject, err error) {
+	if vi.strict {
+		logger.Printf("Invalid %s: %v\n", vo.envName, err)
+	} else {
+		logger.Printf("Ignoring %s: %v\n", vo.envName, err)
+	}
+	vi.invalid = append(vi.invalid, resolvedSecret{vo: vo, err: err})
+}
 
-			if secrettext != "" {
-				fmt.Printf("Checked out secret for %s\\%s\n", v.parentPath, v.secretName)
-				//fmt.Printf("Checked out secret for %s: %s\n", v.secretName, p.(string))
-				// Write to file
-				//err = ioutil.WriteFile(secretsFilesPath+"/"+v.envName, []byte(p.(string)), 0644)
-				err = ioutil.WriteFile(secretsFilesPath+"/"+v.envName, []byte(secrettext), 0644)
-				if err != nil {
-					return fmt.Errorf("Error writing to secret file %s: %s", secretsFilesPath+"/"+v.envName, err)
-				}
-			}
+// splitScheme splits value such as "vault://secret/name" into its URI scheme and path
+// if the scheme is served by a registered backend
+func splitScheme(value string) (string, string, bool) {
+	idx := strings.Index(value, schemeSeparator)
+	if idx <= 0 {
+		return "", "", false
+	}
+	scheme := value[:idx]
+	if _, ok := backendFactories[scheme]; !ok {
+		return "", "", false
+	}
+	return scheme, value[idx+len(schemeSeparator):], true
+}
 
-		} else {
-			// Handle account in system, database and domain
-			resourceID := ""
-			// Get resource ID
-			switch v.resourceType {
-			case "system":
-				resource := platform.NewSystem(vi.vaultClient)
-				resource.Name = v.resourceName
-				result, err := resource.Query()
-				if err != nil {
-					return fmt.Errorf("Error retrieving system object: %s", err)
-				}
-				resource.ID = result["ID"].(string)
-				resourceID = resource.ID
-			case "database":
-				resource := platform.NewDatabase(vi.vaultClient)
-				resource.Name = v.resourceName
-				result, err := resource.Query()
-				if err != nil {
-					return fmt.Errorf("Error retrieving database object: %s", err)
-				}
-				resource.ID = result["ID"].(string)
-				resourceID = resource.ID
-			case "domain":
-				resource := platform.NewDomain(vi.vaultClient)
-				resource.Name = v.resourceName
-				result, err := resource.Query()
-				if err != nil {
-					return fmt.Errorf("Error retrieving domain object: %s", err)
-				}
-				resource.ID = result["ID"].(string)
-				resourceID = resource.ID
+// getSecrets retrieves all secrets, writes them with writeSecrets and reports the outcome of every secret reference.
+// It returns paths of changed files relative to secrets directory.
+func (vi *vaultInjector) getSecrets() ([]string, error) {
+	start := time.Now()
+	results := vi.resolveAll()
+	changed, err := vi.writeSecrets(results)
+	vi.writeReport(vi.newReport(start, results, changed, err))
+	return changed, err
+}
+
+// writeSecrets atomically rewrites secret files and output files whose content has changed.
+// Nothing is written unless every secret is retrieved and every output is rendered successfully. Completion markers are written last.
+// If a file can't be renamed into place, it returns the files already replaced and a *partialWriteError.
+func (vi *vaultInjector) writeSecrets(results []resolvedSecret) ([]string, error) {
+	if err := vi.checkResolved(results); err != nil {
+		return nil, err
+	}
+
+	var written []resolvedSecret
+	secrets := make(map[string]string)
+	files := make(map[string]string)
+	for _, r := range results {
+		if len(r.content) == 0 {
+			// Empty secrets fail checkResolved in strict mode
+			logger.Printf("Skipping %s: secret is empty\n", r.vo.envName)
+			continue
+		}
+		if other, ok := files[r.vo.fileName]; ok {
+			return nil, fmt.Errorf("Secret file %s of %s is also used by %s", r.vo.fileName, r.vo.envName, other)
+		}
+		files[r.vo.fileName] = r.vo.envName
+		written = append(written, r)
+		secrets[r.vo.envName] = string(r.content)
+	}
+	rendered, err := vi.render(secrets)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range rendered {
+		if _, ok := files[f.name]; ok {
+			return nil, fmt.Errorf("Output file %s has the same name as a secret file", f.name)
+		}
+	}
+	subsets, err := vi.containerSubsets(written)
+	if err != nil {
+		return nil, err
+	}
+
+	// Stage every changed file in a temporary file first, so that a failure leaves existing files untouched
+	var changed []string
+	var staged []string
+	cleanup := func() {
+		for _, f := range staged {
+			os.Remove(f)
+		}
+	}
+	stage := func(dir string, name string, content []byte, perm os.FileMode, uid int, gid int) error {
+		filePath := filepath.Join(vi.secretsDir, dir, name)
+		if isUnchanged(filePath, content, perm) {
+			return nil
+		}
+		tmpPath, err := writeTempFile(filePath, content, perm, uid, gid)
+		if err != nil {
+			return fmt.Errorf("Error writing to secret file %s: %s", filePath, err)
+		}
+		staged = append(staged, tmpPath)
+		changed = append(changed, filepath.Join(dir, name))
+		logger.Printf("Updating secret file %s %s\n", filePath, redact.Value(string(content)))
+		return nil
+	}
+	for _, r := range written {
+		if err := stage("", r.vo.fileName, r.content, r.vo.fileMode, r.vo.uid, r.vo.gid); err != nil {
+			cleanup()
+			return nil, err
+		}
+	}
+	for _, f := range rendered {
+		if err := stage("", f.name, f.content, vi.fileMode, vi.fileUID, vi.fileGID); err != nil {
+			cleanup()
+			return nil, err
+		}
+	}
+	for _, subset := range subsets {
+		if err := os.MkdirAll(filepath.Join(vi.secretsDir, subset.dir), 0755); err != nil {
+			cleanup()
+			return nil, fmt.Errorf("Error creating secret directory %s: %s", subset.dir, err)
+		}
+		for _, r := range subset.secrets {
+			if err := stage(subset.dir, r.vo.fileName, r.content, r.vo.fileMode, r.vo.uid, r.vo.gid); err != nil {
+				cleanup()
+				return nil, err
 			}
+		}
+	}
 
-			// Get account ID
-			if resourceID != "" {
-				acct := platform.NewAccount(vi.vaultClient)
-				acct.User = v.secretName
-				switch v.resourceType {
-				case "system":
-					acct.Host = resourceID
-				case "database":
-					acct.DatabaseID = resourceID
-				case "domain":
-					acct.DomainID = resourceID
-				}
-				acctresult, err := acct.Query()
-				if err != nil {
-					return fmt.Errorf("Error retrieving account object: %s", err)
-				}
-				acct.ID = acctresult["ID"].(string)
+	for i, tmpPath := range staged {
+		filePath := filepath.Join(vi.secretsDir, changed[i])
+		if err := os.Rename(tmpPath, filePath); err != nil {
+			// Files renamed so far are already replaced, so only the rest is cleaned up. Completion markers no
+			// longer describe a consistent set of files and are removed until a later run writes all of them.
+			staged = staged[i:]
+			cleanup()
+			vi.removeCompleteMarkers(changed[:i])
+			return changed[:i], &partialWriteError{pending: changed[i:], err: fmt.Errorf("Error writing to secret file %s: %s", filePath, err)}
+		}
+	}
 
-				// Checkout password
-				pw, err := acct.CheckoutPassword(false)
-				if err != nil {
-					return fmt.Errorf("Error checkout credential for %s: %s", acct.User, err)
-				}
+	if err := vi.writeCompleteMarker("", written, len(changedIn("", changed)) > 0); err != nil {
+		return changed, err
+	}
+	for _, subset := range subsets {
+		if err := vi.writeCompleteMarker(subset.dir, subset.secrets, len(changedIn(subset.dir, changed)) > 0); err != nil {
+			return changed, err
+		}
+	}
 
-				if pw != "" {
-					fmt.Printf("Checked out password for %s/%s\n", v.resourceName, v.secretName)
-					//fmt.Printf("Checked out password for %s: %s\n", v.secretName, p.(string))
-					// Write to file
-					err = ioutil.WriteFile(secretsFilesPath+"/"+v.envName, []byte(pw), 0644)
-					if err != nil {
-						return fmt.Errorf("Error writing to secret file %s: %s", secretsFilesPath+"/"+v.envName, err)
-					}
-				}
-			} // End of if resourceID != ""
+	return changed, nil
+}
 
-		} // end of if v.resourceType == "secret"
+// splitQuery splits "path?options" into path and options
+func splitQuery(vaultPath string) (string, string) {
+	if idx := strings.Index(vaultPath, "?"); idx >= 0 {
+		return vaultPath[:idx], vaultPath[idx+1:]
+	}
+	return vaultPath, ""
+}
 
-	} // End of for loop
+// splitFragment splits "path#field" into path and field
+func splitFragment(vaultPath string) (string, string) {
+	if idx := strings.LastIndex(vaultPath, "#"); idx >= 0 {
+		return vaultPath[:idx], vaultPath[idx+1:]
+	}
+	return vaultPath, ""
+}
 
+// parseOptions parses per secret options given as URI query, for example "mode=0400&uid=1000&gid=1000"
+func (vo *vaultObject) parseOptions(query string) error {
+	if query == "" {
+		return nil
+	}
+	options, err := url.ParseQuery(query)
+	if err != nil {
+		return fmt.Errorf("invalid options %s: %v", query, err)
+	}
+	for key := range options {
+		value := options.Get(key)
+		switch key {
+		case "mode":
+			mode, err := parseFileMode(value)
+			if err != nil {
+				return err
+			}
+			vo.fileMode = mode
+		case "uid":
+			if vo.uid, err = strconv.Atoi(value); err != nil {
+				return fmt.Errorf("invalid uid %s", value)
+			}
+		case "gid":
+			if vo.gid, err = strconv.Atoi(value); err != nil {
+				return fmt.Errorf("invalid gid %s", value)
+			}
+		case "file":
+			if err := rules.CheckFileName(value); err != nil {
+				return err
+			}
+			vo.fileName = value
+		case "field":
+			if vo.field != "" && vo.field != value {
+				return fmt.Errorf("field %s conflicts with #%s", value, vo.field)
+			}
+			vo.field = value
+		default:
+			return fmt.Errorf("unknown option %s", key)
+		}
+	}
 	return nil
 }
+
+// parseFileMode parses octal file permission such as "0400"
+func parseFileMode(value string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("invalid file mode %s", value)
+	}
+	return os.FileMode(mode), nil
+}
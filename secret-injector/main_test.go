@@ -0,0 +1,577 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+const testFixture = `
+secrets:
+  testsecret1: "text1"
+  folder1/folder2/testsecret2: "text2"
+  app/db: '{"user": "sa", "password": "dbpass"}'
+  empty: ""
+system:
+  "MySQL (Demo Lab)":
+    dbadmin: "syspass"
+`
+
+// setEnv sets environment variables and returns function restoring them
+func setEnv(t *testing.T, env map[string]string) func() {
+	t.Helper()
+	for name, value := range env {
+		if err := os.Setenv(name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return func() {
+		for name := range env {
+			os.Unsetenv(name)
+		}
+	}
+}
+
+// newTestInjector returns injector serving secrets from fixture, writing to a temporary secrets directory
+func newTestInjector(t *testing.T, fixture string) (*vaultInjector, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "secret-injector")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fixtureFile := filepath.Join(dir, "fixture.yaml")
+	if err := ioutil.WriteFile(fixtureFile, []byte(fixture), 0600); err != nil {
+		t.Fatal(err)
+	}
+	secretsDir := filepath.Join(dir, "secrets")
+	if err := os.Mkdir(secretsDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	vi := &vaultInjector{
+		auth:        "file",
+		fixtureFile: fixtureFile,
+		secretsDir:  secretsDir,
+		fileMode:    0640,
+		fileUID:     -1,
+		fileGID:     -1,
+		workers:     defaultWorkers,
+		strict:      true,
+	}
+	return vi, func() { os.RemoveAll(dir) }
+}
+
+// secretFiles returns content of files in secrets directory by name, excluding the report
+func secretFiles(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string]string)
+	for _, info := range infos {
+		if info.Name() == reportFile {
+			continue
+		}
+		content, err := ioutil.ReadFile(filepath.Join(dir, info.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[info.Name()] = string(content)
+	}
+	return files
+}
+
+func TestGetSecrets(t *testing.T) {
+	tests := []struct {
+		name   string
+		env    map[string]string
+		strict bool
+		files  map[string]string // expected files in secrets directory, nil if nothing is written
+		err    []string          // substrings of expected error
+	}{
+		{
+			name: "all resource types",
+			env: map[string]string{
+				"TEST_SECRET1": "vault://secret/testsecret1",
+				"TEST_SECRET2": "vault://secret/folder1/folder2/testsecret2",
+				"TEST_DBPASS":  "vault://secret/app/db?file=db.pass#password",
+				"TEST_SYSPASS": "vault://system/MySQL (Demo Lab)/dbadmin",
+			},
+			strict: true,
+			files: map[string]string{
+				"TEST_SECRET1":     "text1",
+				"TEST_SECRET2":     "text2",
+				"db.pass":          "dbpass",
+				"TEST_SYSPASS":     "syspass",
+				completeMarkerFile: "TEST_DBPASS=db.pass\nTEST_SECRET1\nTEST_SECRET2\nTEST_SYSPASS\n",
+			},
+		},
+		{
+			name: "missing secret",
+			env: map[string]string{
+				"TEST_SECRET1": "vault://secret/testsecret1",
+				"TEST_MISSING": "vault://secret/folder1/missing",
+				"TEST_ACCOUNT": "vault://system/MySQL (Demo Lab)/nobody",
+			},
+			strict: true,
+			err:    []string{"Failed to inject 2 secret(s)", "TEST_MISSING: Error retrieving secret object: folder1/missing not found", "TEST_ACCOUNT: Error retrieving account object"},
+		},
+		{
+			name: "missing field",
+			env: map[string]string{
+				"TEST_DBPASS": "vault://secret/app/db#nofield",
+			},
+			strict: true,
+			err:    []string{"TEST_DBPASS:"},
+		},
+		{
+			name: "malformed references",
+			env: map[string]string{
+				"TEST_SECRET1":  "vault://secret/testsecret1",
+				"TEST_NONAME":   "vault://secret/",
+				"TEST_NOSYSTEM": "vault://system/MySQL (Demo Lab)",
+				"TEST_UNKNOWN":  "vault://vaults/testsecret1",
+				"TEST_MODE":     "vault://secret/testsecret1?mode=999",
+				"TEST_OPTION":   "vault://secret/testsecret1?color=red",
+			},
+			strict: true,
+			err: []string{
+				"Failed to inject 5 secret(s)",
+				"TEST_NONAME: vault://secret/ must be vault://secret/<path name>/.../<secret name>",
+				"TEST_NOSYSTEM: vault://system/MySQL (Demo Lab) must be vault://system/<system name>/<account name>",
+				"TEST_UNKNOWN: vault://vaults/testsecret1 refers to unknown resource type \"vaults\"",
+				"TEST_MODE: invalid file mode 999",
+				"TEST_OPTION: unknown option color",
+			},
+		},
+		{
+			name: "malformed references skipped in lenient mode",
+			env: map[string]string{
+				"TEST_SECRET1": "vault://secret/testsecret1",
+				"TEST_NONAME":  "vault://secret/",
+				"TEST_EMPTY":   "vault://secret/empty",
+			},
+			files: map[string]string{
+				"TEST_SECRET1":     "text1",
+				completeMarkerFile: "TEST_SECRET1\n",
+			},
+		},
+		{
+			name: "empty secret",
+			env: map[string]string{
+				"TEST_SECRET1": "vault://secret/testsecret1",
+				"TEST_EMPTY":   "vault://secret/empty",
+			},
+			strict: true,
+			err:    []string{"TEST_EMPTY: secret is empty"},
+		},
+		{
+			name: "duplicate file name",
+			env: map[string]string{
+				"TEST_SECRET1": "vault://secret/testsecret1?file=same",
+				"TEST_SECRET2": "vault://secret/folder1/folder2/testsecret2?file=same",
+			},
+			strict: true,
+			err:    []string{"Secret file same of"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vi, cleanup := newTestInjector(t, testFixture)
+			defer cleanup()
+			vi.strict = tt.strict
+			defer setEnv(t, tt.env)()
+
+			vi.parseEnv()
+			if err := vi.initBackends(); err != nil {
+				t.Fatalf("initBackends() error = %v", err)
+			}
+			changed, err := vi.getSecrets()
+
+			if len(tt.err) > 0 {
+				if err == nil {
+					t.Fatal("getSecrets() succeeded, want error")
+				}
+				for _, want := range tt.err {
+					if !strings.Contains(err.Error(), want) {
+						t.Errorf("getSecrets() error = %v, want %q", err, want)
+					}
+				}
+				if files := secretFiles(t, vi.secretsDir); len(files) > 0 {
+					t.Errorf("files written despite error: %v", files)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("getSecrets() error = %v", err)
+			}
+
+			files := secretFiles(t, vi.secretsDir)
+			if len(files) != len(tt.files) {
+				t.Errorf("secret files = %v, want %v", files, tt.files)
+			}
+			for name, want := range tt.files {
+				if name == completeMarkerFile {
+					// Marker lists secrets in the order of environment
+					lines := strings.Split(strings.TrimSpace(files[name]), "\n")
+					sort.Strings(lines)
+					files[name] = strings.Join(lines, "\n") + "\n"
+				}
+				if files[name] != want {
+					t.Errorf("file %s = %q, want %q", name, files[name], want)
+				}
+			}
+			if len(changed) != len(tt.files)-1 {
+				t.Errorf("changed files = %v, want %d", changed, len(tt.files)-1)
+			}
+			info, err := os.Stat(filepath.Join(vi.secretsDir, "TEST_SECRET1"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Mode().Perm() != vi.fileMode {
+				t.Errorf("file mode = %v, want %v", info.Mode().Perm(), vi.fileMode)
+			}
+
+			// Files are only rewritten if secrets change
+			changed, err = vi.getSecrets()
+			if err != nil || len(changed) != 0 {
+				t.Errorf("second getSecrets() = %v, %v, want no changes", changed, err)
+			}
+		})
+	}
+}
+
+// TestGetSecretsPartialWrite checks that files already moved into place are kept when moving another one fails,
+// and that the outcome is reported as partial
+func TestGetSecretsPartialWrite(t *testing.T) {
+	vi, cleanup := newTestInjector(t, testFixture)
+	defer cleanup()
+	defer setEnv(t, map[string]string{"TEST_SECRET1": "vault://secret/testsecret1"})()
+
+	var err error
+	if vi.outputs, err = parseOutputs("dotenv"); err != nil {
+		t.Fatal(err)
+	}
+	// Output file is staged after secret files and can't replace a non-empty directory
+	if err := os.MkdirAll(filepath.Join(vi.secretsDir, "secrets.env", "keep"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(vi.secretsDir, completeMarkerFile), []byte("OLD_SECRET\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	vi.parseEnv()
+	if err := vi.initBackends(); err != nil {
+		t.Fatalf("initBackends() error = %v", err)
+	}
+	changed, err := vi.getSecrets()
+	if err == nil {
+		t.Fatal("getSecrets() succeeded, want error")
+	}
+	if !reflect.DeepEqual(changed, []string{"TEST_SECRET1"}) {
+		t.Errorf("changed files = %v, want [TEST_SECRET1]", changed)
+	}
+
+	infos, err := ioutil.ReadDir(vi.secretsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	// Renamed secret file is kept, temporary file of output is removed and so is the stale marker
+	if want := []string{reportFile, "TEST_SECRET1", "secrets.env"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("files in secrets directory = %v, want %v", names, want)
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(vi.secretsDir, reportFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var r report
+	if err := json.Unmarshal(content, &r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Success || !r.Partial || !reflect.DeepEqual(r.Pending, []string{"secrets.env"}) {
+		t.Errorf("report success = %v, partial = %v, pending = %v, want partial with pending secrets.env", r.Success, r.Partial, r.Pending)
+	}
+	if len(r.Secrets) != 1 || r.Secrets[0].Status != statusInjected {
+		t.Errorf("report secrets = %+v, want TEST_SECRET1 injected", r.Secrets)
+	}
+}
+
+func TestRender(t *testing.T) {
+	secrets := map[string]string{
+		"DB_USER":     "sa",
+		"DB_PASSWORD": "p\"a$s\\w\nord",
+		"CERT":        "line1\nline2\n",
+	}
+
+	tests := []struct {
+		name     string
+		outputs  string            // VAULT_OUTPUT
+		template map[string]string // template file name to template text
+		want     map[string]string // rendered file name to content
+		err      string
+	}{
+		{
+			name:    "dotenv quoting",
+			outputs: "dotenv",
+			want: map[string]string{
+				"secrets.env": `CERT="line1\nline2\n"` + "\n" + `DB_PASSWORD="p\"a\$s\\w\nord"` + "\n" + `DB_USER="sa"` + "\n",
+			},
+		},
+		{
+			name:    "json",
+			outputs: "json:db.json",
+			want: map[string]string{
+				"db.json": "{\n  \"CERT\": \"line1\\nline2\\n\",\n  \"DB_PASSWORD\": \"p\\\"a$s\\\\w\\nord\",\n  \"DB_USER\": \"sa\"\n}",
+			},
+		},
+		{
+			name:    "yaml",
+			outputs: "yaml",
+			want: map[string]string{
+				"secrets.yaml": "CERT: |\n  line1\n  line2\nDB_PASSWORD: |-\n  p\"a$s\\w\n  ord\nDB_USER: sa\n",
+			},
+		},
+		{
+			name: "template fields",
+			template: map[string]string{
+				"db.conf": "user={{ .DB_USER }}\n",
+			},
+			want: map[string]string{
+				"db.conf": "user=sa\n",
+			},
+		},
+		{
+			name: "template funcs",
+			template: map[string]string{
+				"config.yaml": "password: {{ secret \"DB_PASSWORD\" | json }}\ncert: |\n  {{ trim .CERT | indent 2 }}\n",
+				"app.env":     "DB_PASSWORD={{ quote .DB_PASSWORD }}\n",
+			},
+			want: map[string]string{
+				"config.yaml": "password: \"p\\\"a$s\\\\w\\nord\"\ncert: |\n  line1\n  line2\n",
+				"app.env":     `DB_PASSWORD="p\"a\$s\\w\nord"` + "\n",
+			},
+		},
+		{
+			name: "missing field in template",
+			template: map[string]string{
+				"db.conf": "user={{ .DB_ADMIN }}\n",
+			},
+			err: `Error rendering db.conf: template: db.conf:1:8: executing "db.conf" at <.DB_ADMIN>: map has no entry for key "DB_ADMIN"`,
+		},
+		{
+			name: "missing secret in template",
+			template: map[string]string{
+				"db.conf": "user={{ secret \"DB_ADMIN\" }}\n",
+			},
+			err: "secret DB_ADMIN is not defined",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vi := &vaultInjector{}
+			var err error
+			if vi.outputs, err = parseOutputs(tt.outputs); err != nil {
+				t.Fatalf("parseOutputs() error = %v", err)
+			}
+			for name, text := range tt.template {
+				o, err := parseTemplate(name, text)
+				if err != nil {
+					t.Fatalf("parseTemplate() error = %v", err)
+				}
+				vi.outputs = append(vi.outputs, o)
+			}
+
+			files, err := vi.render(secrets)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("render() error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("render() error = %v", err)
+			}
+			got := make(map[string]string)
+			for _, f := range files {
+				got[f.name] = string(f.content)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("render() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInitBackendsFixtureErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		fixture string
+		err     string
+	}{
+		{
+			name:    "unknown section",
+			fixture: "vaults:\n  a: b\n",
+			err:     "Error parsing fixture file",
+		},
+		{
+			name:    "invalid yaml",
+			fixture: "secrets: [",
+			err:     "Error parsing fixture file",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vi, cleanup := newTestInjector(t, tt.fixture)
+			defer cleanup()
+			defer setEnv(t, map[string]string{"TEST_SECRET1": "vault://secret/testsecret1"})()
+
+			vi.parseEnv()
+			if err := vi.initBackends(); err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("initBackends() error = %v, want %q", err, tt.err)
+			}
+		})
+	}
+
+	t.Run("missing fixture file", func(t *testing.T) {
+		vi, cleanup := newTestInjector(t, testFixture)
+		defer cleanup()
+		vi.fixtureFile = filepath.Join(vi.secretsDir, "missing.yaml")
+		defer setEnv(t, map[string]string{"TEST_SECRET1": "vault://secret/testsecret1"})()
+
+		vi.parseEnv()
+		if err := vi.initBackends(); err == nil || !strings.Contains(err.Error(), "Error reading fixture file") {
+			t.Errorf("initBackends() error = %v, want error reading fixture file", err)
+		}
+	})
+}
+
+// treeFiles returns content and permission of files under dir by relative path, excluding the report
+func treeFiles(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	files := make(map[string]string)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || info.Name() == reportFile {
+			return err
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if info.Name() == completeMarkerFile {
+			// Marker lists secrets in the order of environment
+			lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+			sort.Strings(lines)
+			content = []byte(strings.Join(lines, "\n"))
+		}
+		rel, _ := filepath.Rel(dir, path)
+		files[rel] = info.Mode().Perm().String() + " " + string(content)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+// TestDumpEnv checks that sidecar of "dmc" authentication, which loads its environment from file written by
+// centrifycc-enroll.sh, writes the same files as init container that reads it from the container
+func TestDumpEnv(t *testing.T) {
+	vi, cleanup := newTestInjector(t, testFixture)
+	defer cleanup()
+	dir := filepath.Dir(vi.secretsDir)
+	env := map[string]string{
+		"VAULT_AUTHTYPE":              "file",
+		"VAULT_FIXTURE_FILE":          vi.fixtureFile,
+		"VAULT_ENROLLMENTCODE":        "enrollment-code",
+		"VAULT_FILE_MODE":             "0600",
+		"VAULT_OUTPUT":                "dotenv,json:all.json",
+		"VAULT_STRICT":                "false",
+		"VAULT_CONTAINER_SECRETS_app": "TEST_DBPASS",
+		"VAULT_TEMPLATE_app.conf":     "user: sa\npassword: {{ .TEST_DBPASS }}\n",
+		"TEST_SECRET1":                "vault://secret/testsecret1?mode=0400",
+		"TEST_DBPASS":                 "vault://secret/app/db?file=db.pass#password",
+		"TEST_SYSPASS":                "vault://system/MySQL (Demo Lab)/dbadmin",
+		"TEST_NONAME":                 "vault://secret/",
+		"TEST_PLAIN":                  "not a reference",
+	}
+	envFile := filepath.Join(dir, "injector.env.json")
+
+	inject := func(secretsDir string) map[string]string {
+		t.Helper()
+		if err := os.MkdirAll(secretsDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		injector := &vaultInjector{}
+		injector.getCmdParms(flag.NewFlagSet("secret-injector", flag.ContinueOnError), []string{"-secrets-dir", secretsDir})
+		injector.parseEnv()
+		if err := injector.initBackends(); err != nil {
+			t.Fatalf("initBackends() error = %v", err)
+		}
+		if _, err := injector.getSecrets(); err != nil {
+			t.Fatalf("getSecrets() error = %v", err)
+		}
+		return treeFiles(t, secretsDir)
+	}
+
+	// Init container reads environment of the container
+	restore := setEnv(t, env)
+	initFiles := inject(filepath.Join(dir, "init"))
+	if err := dumpEnv(envFile); err != nil {
+		t.Fatalf("dumpEnv() error = %v", err)
+	}
+	restore()
+
+	content, err := ioutil.ReadFile(envFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dumped := make(map[string]string)
+	if err := json.Unmarshal(content, &dumped); err != nil {
+		t.Fatalf("env file is not JSON: %v", err)
+	}
+	for _, name := range []string{"VAULT_ENROLLMENTCODE", "TEST_PLAIN"} {
+		if _, ok := dumped[name]; ok {
+			t.Errorf("env file contains %s", name)
+		}
+	}
+	if dumped["VAULT_TEMPLATE_app.conf"] != env["VAULT_TEMPLATE_app.conf"] {
+		t.Errorf("env file has template %q, want %q", dumped["VAULT_TEMPLATE_app.conf"], env["VAULT_TEMPLATE_app.conf"])
+	}
+
+	// Sidecar runs as systemd service that only gets the env file
+	defer setEnv(t, map[string]string{envFileEnv: envFile})()
+	if err := loadEnv(envFile); err != nil {
+		t.Fatalf("loadEnv() error = %v", err)
+	}
+	defer setEnv(t, dumped)()
+	sidecarFiles := inject(filepath.Join(dir, "sidecar"))
+
+	if !reflect.DeepEqual(sidecarFiles, initFiles) {
+		t.Errorf("sidecar wrote %q, init container wrote %q", sidecarFiles, initFiles)
+	}
+	for _, name := range []string{"all.json", "secrets.env", "app.conf", filepath.Join(containersDir, "app", "db.pass")} {
+		if _, ok := initFiles[name]; !ok {
+			t.Errorf("init container didn't write %s: %q", name, initFiles)
+		}
+	}
+	if want := "-r-------- text1"; initFiles["TEST_SECRET1"] != want {
+		t.Errorf("TEST_SECRET1 = %q, want %q", initFiles["TEST_SECRET1"], want)
+	}
+	if want := "-rw------- dbpass"; initFiles["db.pass"] != want {
+		t.Errorf("db.pass = %q, want %q", initFiles["db.pass"], want)
+	}
+}
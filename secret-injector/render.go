@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"text/template"
+
+	"github.com/marcozj/k8s-secret-injection/internal/rules"
+	"gopkg.in/yaml.v2"
+)
+
+// templateEnvPrefix prefixes env vars holding templates, for example VAULT_TEMPLATE_config.yaml
+const templateEnvPrefix = "VAULT_TEMPLATE_"
+
+// outputFile is a file rendered from all resolved secrets, either a template or an aggregate output
+type outputFile struct {
+	name     string
+	format   string             // aggregate output format. Empty for template
+	template *template.Template // template rendered into the file
+}
+
+// renderedFile is the content of an output file
+type renderedFile struct {
+	name    string
+	content []byte
+}
+
+// parseOutputs parses comma separated aggregate output formats, each optionally followed by ":file name",
+// for example "dotenv,json:config.json"
+func parseOutputs(value string) ([]outputFile, error) {
+	parsed, err := rules.ParseOutputs(value)
+	if err != nil {
+		return nil, err
+	}
+	var outputs []outputFile
+	for _, o := range parsed {
+		outputs = append(outputs, outputFile{name: o.File, format: o.Format})
+	}
+	return outputs, nil
+}
+
+// parseTemplate parses Go text/template rendered into file name. Secrets are referenced by their env var name,
+// for example "password: {{ .DB_PASSWORD }}" or "password: {{ secret "DB_PASSWORD" | json }}"
+func parseTemplate(name string, text string) (outputFile, error) {
+	t, err := rules.ParseTemplate(name, text)
+	if err != nil {
+		return outputFile{}, err
+	}
+	return outputFile{name: name, template: t}, nil
+}
+
+// render renders all output files from resolved secrets, keyed by their env var name
+func (vi *vaultInjector) render(secrets map[string]string) ([]renderedFile, error) {
+	var files []renderedFile
+	for _, o := range vi.outputs {
+		var content []byte
+		var err error
+		switch o.format {
+		case rules.OutputDotenv:
+			content = renderDotenv(secrets)
+		case rules.OutputJSON:
+			content, err = json.MarshalIndent(secrets, "", "  ")
+		case rules.OutputYAML:
+			content, err = yaml.Marshal(secrets)
+		default:
+			var buf bytes.Buffer
+			err = o.template.Funcs(rules.TemplateFuncs(secrets)).Execute(&buf, secrets)
+			content = buf.Bytes()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Error rendering %s: %v", o.name, err)
+		}
+		files = append(files, renderedFile{name: o.name, content: content})
+	}
+	return files, nil
+}
+
+// renderDotenv renders secrets as sorted NAME="value" lines
+func renderDotenv(secrets map[string]string) []byte {
+	var names []string
+	for name := range secrets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var buf bytes.Buffer
+	for _, name := range names {
+		fmt.Fprintf(&buf, "%s=%s\n", name, rules.DotenvQuote(secrets[name]))
+	}
+	return buf.Bytes()
+}
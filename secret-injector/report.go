@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// reportFile is rewritten in secret directory after every run so that applications can tell what was injected
+	reportFile = ".report.json"
+
+	reportJSON = "json"
+
+	// Status of each secret reference in report
+	statusInjected = "injected" // written to secret file
+	statusResolved = "resolved" // checked out but not written since injection failed
+	statusFailed   = "failed"   // check out failed
+	statusEmpty    = "empty"    // checked out secret is empty
+	statusInvalid  = "invalid"  // env var can't be parsed
+)
+
+// report is the outcome of a run of secret injector. It never contains secret values.
+type report struct {
+	Time     time.Time      `json:"time"`
+	Success  bool           `json:"success"`
+	Error    string         `json:"error,omitempty"`
+	Duration float64        `json:"durationSeconds"`
+	Changed  []string       `json:"changed"`           // files changed by the run, relative to secret directory
+	Partial  bool           `json:"partial,omitempty"` // some files were replaced before the run failed
+	Pending  []string       `json:"pending,omitempty"` // changed files not written since the run failed
+	Secrets  []secretReport `json:"secrets"`
+}
+
+// secretReport is the outcome of a single secret reference
+type secretReport struct {
+	EnvName      string  `json:"envName"`
+	File         string  `json:"file,omitempty"`
+	ResourceType string  `json:"resourceType,omitempty"`
+	Path         string  `json:"path,omitempty"`
+	Field        string  `json:"field,omitempty"`
+	Backend      string  `json:"backend,omitempty"`
+	Status       string  `json:"status"`
+	Duration     float64 `json:"durationSeconds"`
+	Error        string  `json:"error,omitempty"`
+}
+
+// newReport describes run that started at start, resolved results and ended with err
+func (vi *vaultInjector) newReport(start time.Time, results []resolvedSecret, changed []string, err error) report {
+	r := report{
+		Time:     start,
+		Success:  err == nil,
+		Duration: time.Since(start).Seconds(),
+		Changed:  changed,
+		Secrets:  []secretReport{},
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	if r.Changed == nil {
+		r.Changed = []string{}
+	}
+	// Secrets of partially written run are injected unless one of their files is pending
+	pending := make(map[string]bool)
+	var partialErr *partialWriteError
+	if errors.As(err, &partialErr) {
+		r.Partial = len(changed) > 0
+		r.Pending = partialErr.pending
+		for _, f := range partialErr.pending {
+			pending[filepath.Base(f)] = true
+		}
+	}
+
+	for _, res := range vi.invalid {
+		r.Secrets = append(r.Secrets, secretReport{
+			EnvName:      res.vo.envName,
+			ResourceType: res.vo.resourceType,
+			Status:       statusInvalid,
+			Error:        res.err.Error(),
+		})
+	}
+	for _, res := range results {
+		s := secretReport{
+			EnvName:      res.vo.envName,
+			File:         res.vo.fileName,
+			ResourceType: res.vo.resourceType,
+			Path:         refPath(res.vo),
+			Field:        res.vo.field,
+			Backend:      vi.backendName(res.vo.scheme),
+			Duration:     res.duration.Seconds(),
+		}
+		switch {
+		case res.err != nil:
+			s.Status = statusFailed
+			s.Error = res.err.Error()
+		case len(res.content) == 0:
+			s.Status = statusEmpty
+		case err != nil && (partialErr == nil || pending[res.vo.fileName]):
+			s.Status = statusResolved
+		default:
+			s.Status = statusInjected
+		}
+		r.Secrets = append(r.Secrets, s)
+	}
+	return r
+}
+
+// refPath returns "/" separated path of referenced secret or account without resource type, for example "folder1/secret1"
+func refPath(vo vaultObject) string {
+	if vo.resourceType == "secret" {
+		if vo.parentPath == "" {
+			return vo.secretName
+		}
+		return strings.Replace(vo.parentPath, "\\", "/", -1) + "/" + vo.secretName
+	}
+	return vo.resourceName + "/" + vo.secretName
+}
+
+// writeReport writes report to secret directory, and to stdout if report format is set.
+// Failures are only logged since report must not fail secret injection.
+func (vi *vaultInjector) writeReport(r report) {
+	content, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		logger.Printf("Error encoding report: %v\n", err)
+		return
+	}
+	if err := writeFileAtomic(filepath.Join(vi.secretsDir, reportFile), append(content, '\n'), 0644); err != nil {
+		logger.Printf("Error writing report: %v\n", err)
+	}
+	if vi.reportFormat == reportJSON {
+		// One line for every run, so that reports of watch mode can be read as they come
+		line, _ := json.Marshal(r)
+		fmt.Fprintln(os.Stdout, string(line))
+	}
+}
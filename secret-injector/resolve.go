@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultWorkers = 4
+
+// resolvedSecret is the outcome of resolving one vault object
+type resolvedSecret struct {
+	vo       vaultObject
+	content  []byte
+	err      error
+	duration time.Duration // time taken to resolve, including retries
+}
+
+// secretErrors aggregates failures of all secret references in the order secrets are parsed
+type secretErrors []error
+
+func (e secretErrors) Error() string {
+	var msgs []string
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return fmt.Sprintf("Failed to inject %d secret(s):\n%s", len(e), strings.Join(msgs, "\n"))
+}
+
+// resolveAll resolves every parsed vault object using a bounded number of concurrent workers.
+// Results are returned in the same order as vi.secrets.
+func (vi *vaultInjector) resolveAll() []resolvedSecret {
+	results := make([]resolvedSecret, len(vi.secrets))
+	workers := vi.workers
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(vi.secrets) {
+		workers = len(vi.secrets)
+	}
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				v := vi.secrets[i]
+				start := time.Now()
+				content, err := vi.backends[v.scheme].Resolve(v)
+				if err == nil && v.field != "" {
+					content, err = extractField(content, v.field)
+				}
+				results[i] = resolvedSecret{vo: v, content: content, err: err, duration: time.Since(start)}
+			}
+		}()
+	}
+	for i := range vi.secrets {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	return results
+}
+
+// checkResolved returns error listing every failed lookup, or nil if all succeeded. In strict mode
+// env vars that couldn't be parsed and secrets that are empty are listed too.
+func (vi *vaultInjector) checkResolved(results []resolvedSecret) error {
+	var errs secretErrors
+	if vi.strict {
+		for _, r := range vi.invalid {
+			errs = append(errs, fmt.Errorf("%s: %v", r.vo.envName, r.err))
+		}
+	}
+	for _, r := range results {
+		if r.err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", r.vo.envName, r.err))
+		} else if vi.strict && len(r.content) == 0 {
+			errs = append(errs, fmt.Errorf("%s: secret is empty", r.vo.envName))
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
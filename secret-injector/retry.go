@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/marcozj/golang-sdk/restapi"
+)
+
+const (
+	defaultRetryAttempts   = 5
+	defaultRetryBackoff    = 1 * time.Second
+	defaultRetryMaxBackoff = 30 * time.Second
+	defaultRetryJitter     = 0.2
+	defaultRetryDeadline   = 2 * time.Minute
+	defaultRequestTimeout  = 30 * time.Second
+)
+
+// retryPolicy controls how calls to tenant are retried when they fail with transient errors
+type retryPolicy struct {
+	maxAttempts    int           // maximum number of attempts including the first one
+	initialBackoff time.Duration // wait time before the first retry. It doubles for every further retry
+	maxBackoff     time.Duration // upper limit of wait time between retries
+	jitter         float64       // fraction of wait time that is randomly added or subtracted
+	deadline       time.Duration // overall time limit for all attempts of one call
+	requestTimeout time.Duration // time limit of a single HTTP request to tenant
+}
+
+var (
+	jitterRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	jitterLock sync.Mutex
+)
+
+// do calls fn until it succeeds, fails with permanent error, or attempts or deadline are exhausted
+func (p retryPolicy) do(desc string, fn func() error) error {
+	start := time.Now()
+	backoff := p.initialBackoff
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || !isRetriable(err) {
+			return err
+		}
+		if attempt >= p.maxAttempts {
+			return fmt.Errorf("%s failed after %d attempts: %w", desc, attempt, err)
+		}
+		wait := p.withJitter(backoff)
+		if p.deadline > 0 && time.Since(start)+wait > p.deadline {
+			return fmt.Errorf("%s failed, retry deadline %v exceeded after %d attempts: %w", desc, p.deadline, attempt, err)
+		}
+
+		logger.Printf("%s failed (attempt %d of %d), retrying in %v: %v\n", desc, attempt, p.maxAttempts, wait, err)
+		time.Sleep(wait)
+
+		backoff *= 2
+		if backoff > p.maxBackoff {
+			backoff = p.maxBackoff
+		}
+	}
+}
+
+func (p retryPolicy) withJitter(d time.Duration) time.Duration {
+	if p.jitter <= 0 {
+		return d
+	}
+	jitterLock.Lock()
+	f := jitterRand.Float64()
+	jitterLock.Unlock()
+	// Spread wait time evenly within [d - jitter*d, d + jitter*d]
+	return time.Duration(float64(d) * (1 + p.jitter*(2*f-1)))
+}
+
+// isRetriable tells whether err is transient. Network errors, timeouts, throttling and server side (5xx) failures
+// are transient. Everything else, such as unauthorized or object not found, is permanent.
+func isRetriable(err error) bool {
+	var httpErr *restapi.HttpError
+	if errors.As(err, &httpErr) {
+		return httpErr.StatusCode >= http.StatusInternalServerError || httpErr.StatusCode == http.StatusTooManyRequests
+	}
+	var tokenErr *tokenEndpointError
+	if errors.As(err, &tokenErr) {
+		return tokenErr.StatusCode >= http.StatusInternalServerError || tokenErr.StatusCode == http.StatusTooManyRequests
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
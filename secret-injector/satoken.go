@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/marcozj/golang-sdk/oauth"
+)
+
+const (
+	// defaultSATokenFile is where webhook mounts projected ServiceAccount token of the pod
+	defaultSATokenFile = "/var/run/secrets/centrify/token"
+
+	grantTypeTokenExchange = "urn:ietf:params:oauth:grant-type:token-exchange"
+	tokenTypeJWT           = "urn:ietf:params:oauth:token-type:jwt"
+	tokenTypeAccessToken   = "urn:ietf:params:oauth:token-type:access_token"
+)
+
+// tokenEndpointError is an error response of token endpoint
+type tokenEndpointError struct {
+	StatusCode  int
+	Code        string
+	Description string
+}
+
+func (e *tokenEndpointError) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("token endpoint returned %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("token endpoint returned %d %s: %s %s", e.StatusCode, http.StatusText(e.StatusCode), e.Code, e.Description)
+}
+
+// getServiceAccountRestClient exchanges projected ServiceAccount token of the pod for an OAuth2 access token
+// with OAuth 2.0 Token Exchange (RFC 8693). Token file is read on every authentication since kubelet rotates it.
+func (vi *vaultInjector) getServiceAccountRestClient() error {
+	saToken, err := ioutil.ReadFile(vi.saTokenFile)
+	if err != nil {
+		return fmt.Errorf("Unable to read ServiceAccount token: %v", err)
+	}
+
+	accessToken, err := vi.exchangeToken(strings.TrimSpace(string(saToken)))
+	if err != nil {
+		return err
+	}
+
+	call := oauth.OauthClient{
+		Service:        vi.url,
+		AppID:          vi.appid,
+		Scope:          vi.scope,
+		SkipCertVerify: vi.skipcert,
+	}
+	vi.vaultClient, err = call.GetRestClient(&oauth.TokenResponse{AccessToken: accessToken, TokenType: "Bearer"})
+	return err
+}
+
+// exchangeToken returns access token issued by token endpoint for ServiceAccount token
+func (vi *vaultInjector) exchangeToken(saToken string) (string, error) {
+	endpoint := vi.tokenEndpoint
+	if endpoint == "" {
+		// OAuth2 Client web application of Centrify tenant
+		endpoint = strings.TrimSuffix(vi.url, "/") + "/oauth2/token/" + vi.appid
+	}
+	form := url.Values{
+		"grant_type":           {grantTypeTokenExchange},
+		"subject_token":        {saToken},
+		"subject_token_type":   {tokenTypeJWT},
+		"requested_token_type": {tokenTypeAccessToken},
+	}
+	if vi.scope != "" {
+		form.Set("scope", vi.scope)
+	}
+
+	client := &http.Client{Timeout: vi.retry.requestTimeout}
+	if vi.skipcert {
+		// Ignore certificate error for on-prem deployment
+		client.Transport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	}
+	resp, err := client.PostForm(endpoint, form)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		AccessToken      string `json:"access_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	decodeErr := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body)
+	if resp.StatusCode != http.StatusOK {
+		return "", &tokenEndpointError{StatusCode: resp.StatusCode, Code: body.Error, Description: body.ErrorDescription}
+	}
+	if decodeErr != nil {
+		return "", fmt.Errorf("Invalid response of token endpoint %s: %v", endpoint, decodeErr)
+	}
+	if body.AccessToken == "" {
+		return "", fmt.Errorf("Token endpoint %s returned no access token", endpoint)
+	}
+	return body.AccessToken, nil
+}
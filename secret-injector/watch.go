@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// changeEventFile is rewritten in secret directory every time secret files change so that other
+// containers sharing the volume, such as app launcher, can react to rotated secrets
+const changeEventFile = ".changed"
+
+// changeEvent is the content of changeEventFile
+type changeEvent struct {
+	Generation int       `json:"generation"` // incremented for every change
+	Time       time.Time `json:"time"`
+	Changed    []string  `json:"changed"` // names of changed secret files
+}
+
+// watch re-resolves all secrets on every interval and whenever SIGHUP is received until SIGINT or SIGTERM.
+// Failed refreshes are reported and existing secret files are kept.
+func (vi *vaultInjector) watch() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+
+	ticker := time.NewTicker(vi.watchInterval)
+	defer ticker.Stop()
+
+	// Continue numbering of change events emitted before a restart
+	if content, err := ioutil.ReadFile(filepath.Join(vi.secretsDir, changeEventFile)); err == nil {
+		var last changeEvent
+		if json.Unmarshal(content, &last) == nil {
+			vi.generation = last.Generation
+		}
+	}
+
+	logger.Printf("Watching secrets every %v\n", vi.watchInterval)
+	for {
+		if err := vi.refresh(); err != nil {
+			logger.Printf("Failed to refresh secrets: %v\n", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-hup:
+			logger.Println("Received SIGHUP, refreshing secrets")
+		case sig := <-stop:
+			logger.Printf("Received %v, stop watching secrets\n", sig)
+			return
+		}
+	}
+}
+
+// refresh authenticates again, since tokens may have expired since last refresh, then rewrites changed secret files
+func (vi *vaultInjector) refresh() error {
+	if err := vi.initBackends(); err != nil {
+		return err
+	}
+	changed, err := vi.getSecrets()
+	if err != nil {
+		return err
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+	vi.generation++
+	logger.Printf("Secrets changed: %v\n", changed)
+	if err := vi.emitChangeEvent("", changedIn("", changed)); err != nil {
+		return err
+	}
+	for container := range vi.containerSecrets {
+		dir := containerDir(container)
+		if names := changedIn(dir, changed); len(names) > 0 {
+			if err := vi.emitChangeEvent(dir, names); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// emitChangeEvent records names of changed secret files in changeEventFile of dir, relative to secrets directory
+func (vi *vaultInjector) emitChangeEvent(dir string, changed []string) error {
+	event := changeEvent{
+		Generation: vi.generation,
+		Time:       time.Now().UTC(),
+		Changed:    changed,
+	}
+	content, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	eventPath := filepath.Join(vi.secretsDir, dir, changeEventFile)
+	if err := writeFileAtomic(eventPath, content, 0644); err != nil {
+		return fmt.Errorf("Error writing change event %s: %s", eventPath, err)
+	}
+	return nil
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+	"sigs.k8s.io/yaml"
+)
+
+// webhookConfig holds defaults of webhook server. Annotations of a pod override them.
+//
+//	tenantURL: https://abc0751.my.centrify.net
+//	authType: oauth
+//	tokenAudience: vault.example.com
+//	initImage: registry.example.com/centrify/secret-injector-oauth:1.0
+//	imagePullPolicy: Always
+//	initResources:
+//	  limits:
+//	    memory: 64Mi
+//	ignoredNamespaces: [kube-system, kube-public, monitoring]
+//	allowedAnnotations: [tenant-url, scope, appid, oauth-secret-name, "vaultsecret_*"]
+//	onImageLookupFailure: deny
+type webhookConfig struct {
+	TenantURL        string                      `json:"tenantURL,omitempty"`
+	AuthType         string                      `json:"authType,omitempty"`
+	InitImage        string                      `json:"initImage,omitempty"`
+	SidecarImage     string                      `json:"sidecarImage,omitempty"`
+	ImagePullPolicy  corev1.PullPolicy           `json:"imagePullPolicy,omitempty"`
+	InitResources    corev1.ResourceRequirements `json:"initResources,omitempty"`
+	SidecarResources corev1.ResourceRequirements `json:"sidecarResources,omitempty"`
+	// Audience of projected ServiceAccount token and endpoint it is exchanged at for k8s authentication.
+	// Audience defaults to tenant URL and endpoint to OAuth2 token endpoint of appid.
+	TokenAudience string `json:"tokenAudience,omitempty"`
+	TokenEndpoint string `json:"tokenEndpoint,omitempty"`
+	// Path of app launcher that container commands are mutated to use unless app-launcher annotation is set
+	AppLauncher       string   `json:"appLauncher,omitempty"`
+	IgnoredNamespaces []string `json:"ignoredNamespaces,omitempty"`
+	// Names of annotations, without vault.centrify.com/ prefix, that pods may set. Names ending with "*" match by prefix.
+	// All annotations are allowed if it is empty. Other annotations are ignored by both mutation and validation.
+	AllowedAnnotations []string `json:"allowedAnnotations,omitempty"`
+	// What happens to a pod if command of a container can't be determined because its image can't be looked up:
+	// "deny" (default) denies creation of the pod, "admit" admits it unmodified, without secrets.
+	OnImageLookupFailure string `json:"onImageLookupFailure,omitempty"`
+}
+
+const (
+	imageLookupFailureDeny  = "deny"
+	imageLookupFailureAdmit = "admit"
+)
+
+// alwaysAllowedAnnotations are needed to decide whether to mutate a pod at all
+var alwaysAllowedAnnotations = []string{annotationMutate, annotationStatus}
+
+// knownAnnotations are all annotations understood by webhook. Those ending with "*" are prefixes.
+var knownAnnotations = []string{
+	annotationMutate, annotationStatus, annotationAppLauncher, annotationTenanturl, annotationAppID,
+	annotationScope, annotationToken, annotationUser, annotationPasswordFile, annotationWorkers,
+	annotationRetryAttempts, annotationRetryDeadline, annotationRequestTimeout, annotationRefreshInterval,
+	annotationFileMode, annotationFileUID, annotationFileGID, annotationReadyTimeout, annotationEnvCollision,
+	annotationFilesOnly, annotationSecretsPath, annotationContainers, annotationSupervise,
+	annotationOnSecretChange, annotationReloadSignal, annotationOauthSecretName, annotationEnrollmentCode,
+	annotationAuthType, annotationTokenFile, annotationTokenAudience, annotationTokenEndpoint, annotationOutput, annotationStrict, annotationInitContainer, annotationSidecarContainer,
+	annotationInitImage, annotationSidecarImage,
+	annotationSecretPrefix + "*", annotationTemplatePrefix + "*", annotationContainerSecrets + "*",
+}
+
+var (
+	webhookCfgMu sync.RWMutex
+	// webhookCfg holds defaults that annotations of pods override. It is replaced when config file changes.
+	webhookCfg = defaultWebhookConfig()
+)
+
+// currentWebhookConfig returns configuration that a pod is mutated with. It must not be modified.
+func currentWebhookConfig() *webhookConfig {
+	webhookCfgMu.RLock()
+	defer webhookCfgMu.RUnlock()
+	return webhookCfg
+}
+
+func setWebhookConfig(cfg *webhookConfig) {
+	webhookCfgMu.Lock()
+	defer webhookCfgMu.Unlock()
+	webhookCfg = cfg
+}
+
+// defaultWebhookConfig returns configuration used without config file
+func defaultWebhookConfig() *webhookConfig {
+	return &webhookConfig{
+		InitImage:       "centrify/secret-injector-oauth",
+		SidecarImage:    "centrify/secret-injector-dmc",
+		ImagePullPolicy: corev1.PullIfNotPresent,
+		IgnoredNamespaces: []string{
+			metav1.NamespaceSystem,
+			metav1.NamespacePublic,
+		},
+	}
+}
+
+// loadWebhookConfig reads config file over the defaults and validates it
+func loadWebhookConfig(configFile string) (*webhookConfig, error) {
+	cfg := defaultWebhookConfig()
+	if configFile == "" {
+		return cfg, nil
+	}
+	content, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading config file %s: %v", configFile, err)
+	}
+	if err := yaml.UnmarshalStrict(content, cfg); err != nil {
+		return nil, fmt.Errorf("Error parsing config file %s: %v", configFile, err)
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("Invalid config file %s: %v", configFile, err)
+	}
+	return cfg, nil
+}
+
+// validate reports every invalid setting
+func (c *webhookConfig) validate() error {
+	var errs []string
+	if c.TenantURL != "" {
+		if u, err := url.Parse(c.TenantURL); err != nil || u.Scheme != "https" || u.Host == "" {
+			errs = append(errs, fmt.Sprintf("tenantURL %q must be an https URL", c.TenantURL))
+		}
+	}
+	switch strings.ToLower(c.AuthType) {
+	case "", "oauth", "unpw", "dmc", "k8s":
+	default:
+		errs = append(errs, fmt.Sprintf("authType %q must be oauth, unpw, dmc or k8s", c.AuthType))
+	}
+	if c.TokenEndpoint != "" {
+		if u, err := url.Parse(c.TokenEndpoint); err != nil || u.Scheme != "https" || u.Host == "" {
+			errs = append(errs, fmt.Sprintf("tokenEndpoint %q must be an https URL", c.TokenEndpoint))
+		}
+	}
+	if c.InitImage == "" {
+		errs = append(errs, "initImage must not be empty")
+	}
+	if c.SidecarImage == "" {
+		errs = append(errs, "sidecarImage must not be empty")
+	}
+	switch c.ImagePullPolicy {
+	case corev1.PullAlways, corev1.PullIfNotPresent, corev1.PullNever:
+	default:
+		errs = append(errs, fmt.Sprintf("imagePullPolicy %q must be Always, IfNotPresent or Never", c.ImagePullPolicy))
+	}
+	if c.AppLauncher != "" && !strings.HasPrefix(c.AppLauncher, "/") {
+		errs = append(errs, fmt.Sprintf("appLauncher %q must be an absolute path", c.AppLauncher))
+	}
+	switch c.OnImageLookupFailure {
+	case "", imageLookupFailureDeny, imageLookupFailureAdmit:
+	default:
+		errs = append(errs, fmt.Sprintf("onImageLookupFailure %q must be deny or admit", c.OnImageLookupFailure))
+	}
+	for _, name := range c.AllowedAnnotations {
+		if !isKnownAnnotation(annotationPrefix + name) {
+			errs = append(errs, fmt.Sprintf("allowedAnnotations contains unknown annotation %q", name))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// isKnownAnnotation tells whether name, possibly a prefix pattern ending with "*", is understood by webhook
+func isKnownAnnotation(name string) bool {
+	for _, known := range knownAnnotations {
+		if name == known {
+			return true
+		}
+		if strings.HasSuffix(known, "*") && !strings.HasSuffix(name, "*") && strings.HasPrefix(name, strings.TrimSuffix(known, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// isAllowed tells whether pods may set annotation key
+func (c *webhookConfig) isAllowed(key string) bool {
+	if len(c.AllowedAnnotations) == 0 || !strings.HasPrefix(key, annotationPrefix) {
+		return true
+	}
+	for _, a := range alwaysAllowedAnnotations {
+		if key == a {
+			return true
+		}
+	}
+	name := strings.TrimPrefix(key, annotationPrefix)
+	for _, allowed := range c.AllowedAnnotations {
+		if name == allowed || (strings.HasSuffix(allowed, "*") && strings.HasPrefix(name, strings.TrimSuffix(allowed, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterAnnotations returns annotations that pods are allowed to set
+func (c *webhookConfig) filterAnnotations(annotations map[string]string) map[string]string {
+	result := make(map[string]string, len(annotations))
+	for key, value := range annotations {
+		if !c.isAllowed(key) {
+			klog.Infof("Ignoring annotation %s that is not allowed by config", key)
+			continue
+		}
+		result[key] = value
+	}
+	return result
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	v1 "k8s.io/api/admission/v1"
+	"k8s.io/api/admission/v1beta1"
+)
+
+// TestConvertAdmissionRequestToV1 checks that every field of v1beta1 request is carried over, including the raw
+// object, and that fields older API servers don't send stay unset
+func TestConvertAdmissionRequestToV1(t *testing.T) {
+	var review v1beta1.AdmissionReview
+	if err := json.Unmarshal(readTestdata(t, "admissionreview-v1beta1.json"), &review); err != nil {
+		t.Fatal(err)
+	}
+	got := convertAdmissionRequestToV1(review.Request)
+
+	// Both versions of AdmissionRequest have the same JSON encoding
+	asMap := func(r interface{}) map[string]interface{} {
+		t.Helper()
+		b, err := json.Marshal(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := make(map[string]interface{})
+		if err := json.Unmarshal(b, &m); err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+	if want := asMap(review.Request); !reflect.DeepEqual(asMap(got), want) {
+		t.Errorf("convertAdmissionRequestToV1() = %v, want %v", asMap(got), want)
+	}
+	if string(got.Object.Raw) != string(review.Request.Object.Raw) {
+		t.Errorf("object = %s, want %s", got.Object.Raw, review.Request.Object.Raw)
+	}
+	if got.RequestKind != nil || got.RequestResource != nil || got.Options.Raw != nil {
+		t.Errorf("request has fields v1beta1 request didn't: %+v", got)
+	}
+	if convertAdmissionRequestToV1(nil) != nil {
+		t.Error("convertAdmissionRequestToV1(nil) is not nil")
+	}
+}
+
+func TestConvertAdmissionResponseToV1beta1(t *testing.T) {
+	patchType := v1.PatchTypeJSONPatch
+	tests := []struct {
+		name string
+		resp *v1.AdmissionResponse
+	}{
+		{
+			name: "patched",
+			resp: &v1.AdmissionResponse{UID: "uid", Allowed: true, Patch: []byte(`[]`), PatchType: &patchType},
+		},
+		{
+			name: "not patched",
+			resp: &v1.AdmissionResponse{UID: "uid", Allowed: true},
+		},
+		{
+			name: "denied",
+			resp: admissionResponseError(errors.New("pod is denied")),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := convertAdmissionResponseToV1beta1(tt.resp)
+			if got.UID != tt.resp.UID || got.Allowed != tt.resp.Allowed || string(got.Patch) != string(tt.resp.Patch) ||
+				!reflect.DeepEqual(got.Result, tt.resp.Result) {
+				t.Errorf("convertAdmissionResponseToV1beta1() = %+v, want %+v", got, tt.resp)
+			}
+			switch {
+			case tt.resp.PatchType == nil && got.PatchType != nil:
+				t.Errorf("patch type = %q, want none", *got.PatchType)
+			case tt.resp.PatchType != nil && (got.PatchType == nil || *got.PatchType != v1beta1.PatchTypeJSONPatch):
+				t.Errorf("patch type = %v, want JSONPatch", got.PatchType)
+			}
+		})
+	}
+	if convertAdmissionResponseToV1beta1(nil) != nil {
+		t.Error("convertAdmissionResponseToV1beta1(nil) is not nil")
+	}
+}
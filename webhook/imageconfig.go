@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	serviceAccountPath        = "/var/run/secrets/kubernetes.io/serviceaccount"
+	defaultImageLookupTimeout = 10 * time.Second
+)
+
+// imageConfigSource looks up entrypoint and cmd of container images
+type imageConfigSource interface {
+	// Lookup returns configuration of image of a pod in namespace, using its image pull secrets if needed.
+	// It gives up when ctx is done.
+	Lookup(ctx context.Context, image string, namespace string, pullSecrets []corev1.LocalObjectReference) (imageConfig, error)
+}
+
+var (
+	// imageConfigs is the source used by mutateCommand for containers without command. It is nil if lookup is disabled.
+	imageConfigs imageConfigSource
+	// imageLookupTimeout bounds all image lookups of a pod, including token and manifest requests.
+	// It must be shorter than timeoutSeconds of MutatingWebhookConfiguration.
+	imageLookupTimeout = defaultImageLookupTimeout
+)
+
+// registryImageConfigs looks up images in their registries
+type registryImageConfigs struct {
+	registry *registryClient
+	secrets  *kubeSecrets // nil unless reading image pull secrets is enabled, then registries are accessed anonymously
+}
+
+func (r *registryImageConfigs) Lookup(ctx context.Context, image string, namespace string, pullSecrets []corev1.LocalObjectReference) (imageConfig, error) {
+	ref, err := parseImageRef(image)
+	if err != nil {
+		return imageConfig{}, err
+	}
+	var creds *registryCredentials
+	for _, s := range pullSecrets {
+		if r.secrets == nil {
+			break
+		}
+		secret, err := r.secrets.get(ctx, namespace, s.Name)
+		if err != nil {
+			return imageConfig{}, fmt.Errorf("Can't read image pull secret %s: %v", s.Name, err)
+		}
+		if creds = dockerCredentials(secret, ref.domain); creds != nil {
+			break
+		}
+	}
+	return r.registry.lookup(ctx, ref, creds)
+}
+
+// fixtureImageConfigs serves image configurations from a local file instead of registries, so that webhook can run without them
+//
+//	images:
+//	  "nginx:1.19":
+//	    entrypoint: ["/docker-entrypoint.sh"]
+//	    cmd: ["nginx", "-g", "daemon off;"]
+type fixtureImageConfigs struct {
+	Images map[string]imageConfig `json:"images"`
+}
+
+func newFixtureImageConfigs(fixtureFile string) (*fixtureImageConfigs, error) {
+	content, err := ioutil.ReadFile(fixtureFile)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading image fixture file %s: %s", fixtureFile, err)
+	}
+	f := &fixtureImageConfigs{}
+	if err := yaml.UnmarshalStrict(content, f); err != nil {
+		return nil, fmt.Errorf("Error parsing image fixture file %s: %s", fixtureFile, err)
+	}
+	return f, nil
+}
+
+func (f *fixtureImageConfigs) Lookup(ctx context.Context, image string, namespace string, pullSecrets []corev1.LocalObjectReference) (imageConfig, error) {
+	config, ok := f.Images[image]
+	if !ok {
+		return imageConfig{}, fmt.Errorf("image %s not found in fixture", image)
+	}
+	return config, nil
+}
+
+// dockerCredentials returns credentials for registry domain from a kubernetes.io/dockerconfigjson or kubernetes.io/dockercfg secret
+func dockerCredentials(secret *corev1.Secret, domain string) *registryCredentials {
+	type authEntry struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+		Auth     string `json:"auth"`
+	}
+	var auths map[string]authEntry
+	if content, ok := secret.Data[corev1.DockerConfigJsonKey]; ok {
+		var config struct {
+			Auths map[string]authEntry `json:"auths"`
+		}
+		if json.Unmarshal(content, &config) != nil {
+			return nil
+		}
+		auths = config.Auths
+	} else if content, ok := secret.Data[corev1.DockerConfigKey]; ok {
+		if json.Unmarshal(content, &auths) != nil {
+			return nil
+		}
+	}
+
+	for key, entry := range auths {
+		if registryDomain(key) != domain {
+			continue
+		}
+		if entry.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+			if err != nil {
+				continue
+			}
+			split := strings.SplitN(string(decoded), ":", 2)
+			if len(split) == 2 {
+				return &registryCredentials{username: split[0], password: split[1]}
+			}
+		}
+		return &registryCredentials{username: entry.Username, password: entry.Password}
+	}
+	return nil
+}
+
+// registryDomain normalizes registry key of docker config such as "https://index.docker.io/v1/" to domain of image reference
+func registryDomain(key string) string {
+	key = strings.TrimPrefix(strings.TrimPrefix(key, "https://"), "http://")
+	if idx := strings.Index(key, "/"); idx >= 0 {
+		key = key[:idx]
+	}
+	switch key {
+	case "index.docker.io", dockerHubRegistry:
+		return dockerHubDomain
+	}
+	return key
+}
+
+// kubeSecrets reads secrets from Kubernetes API with service account of webhook
+type kubeSecrets struct {
+	host   string
+	token  string
+	client *http.Client
+}
+
+// newKubeSecrets returns client of Kubernetes API of the cluster that webhook runs in
+func newKubeSecrets(timeout time.Duration) (*kubeSecrets, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running in a Kubernetes cluster")
+	}
+	token, err := ioutil.ReadFile(serviceAccountPath + "/token")
+	if err != nil {
+		return nil, err
+	}
+	ca, err := ioutil.ReadFile(serviceAccountPath + "/ca.crt")
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(ca)
+	return &kubeSecrets{
+		host:  net.JoinHostPort(host, port),
+		token: strings.TrimSpace(string(token)),
+		client: &http.Client{
+			Timeout:   timeout,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		},
+	}, nil
+}
+
+func (k *kubeSecrets) get(ctx context.Context, namespace string, name string) (*corev1.Secret, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("https://%s/api/v1/namespaces/%s/secrets/%s", k.host, namespace, name), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+k.token)
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s", resp.Status)
+	}
+	secret := &corev1.Secret{}
+	if err := json.NewDecoder(resp.Body).Decode(secret); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestDockerCredentials(t *testing.T) {
+	auth := base64.StdEncoding.EncodeToString([]byte("user:pass:word"))
+	tests := []struct {
+		name   string
+		secret corev1.Secret
+		domain string
+		want   *registryCredentials
+	}{
+		{
+			name: "dockerconfigjson auth",
+			secret: corev1.Secret{Data: map[string][]byte{
+				corev1.DockerConfigJsonKey: []byte(`{"auths":{"registry.example.com:5000":{"auth":"` + auth + `"}}}`),
+			}},
+			domain: "registry.example.com:5000",
+			want:   &registryCredentials{username: "user", password: "pass:word"},
+		},
+		{
+			name: "dockerconfigjson username and password",
+			secret: corev1.Secret{Data: map[string][]byte{
+				corev1.DockerConfigJsonKey: []byte(`{"auths":{"https://index.docker.io/v1/":{"username":"user","password":"pass"}}}`),
+			}},
+			domain: dockerHubDomain,
+			want:   &registryCredentials{username: "user", password: "pass"},
+		},
+		{
+			name: "dockercfg",
+			secret: corev1.Secret{Data: map[string][]byte{
+				corev1.DockerConfigKey: []byte(`{"https://gcr.io":{"auth":"` + auth + `"}}`),
+			}},
+			domain: "gcr.io",
+			want:   &registryCredentials{username: "user", password: "pass:word"},
+		},
+		{
+			name: "other registry",
+			secret: corev1.Secret{Data: map[string][]byte{
+				corev1.DockerConfigJsonKey: []byte(`{"auths":{"gcr.io":{"auth":"` + auth + `"}}}`),
+			}},
+			domain: "registry.example.com",
+		},
+		{
+			name:   "not a docker config",
+			secret: corev1.Secret{Data: map[string][]byte{"password": []byte("secret")}},
+			domain: "gcr.io",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := dockerCredentials(&tt.secret, tt.domain); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("dockerCredentials() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestRegistryImageConfigsLookup reads image pull secret from a Kubernetes API stand-in and uses it with registry
+func TestRegistryImageConfigsLookup(t *testing.T) {
+	r := newFakeRegistry(t, "bearer")
+	defer r.server.Close()
+
+	auth := base64.StdEncoding.EncodeToString([]byte(testUsername + ":" + testPassword))
+	api := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer sa-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if req.URL.Path != "/api/v1/namespaces/team/secrets/regcred" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(corev1.Secret{
+			Type: corev1.SecretTypeDockerConfigJson,
+			Data: map[string][]byte{
+				corev1.DockerConfigJsonKey: []byte(`{"auths":{"` + r.host(t) + `":{"auth":"` + auth + `"}}}`),
+			},
+		})
+	}))
+	defer api.Close()
+
+	source := &registryImageConfigs{
+		registry: r.client(t, "linux/amd64"),
+		secrets:  &kubeSecrets{host: strings.TrimPrefix(api.URL, "https://"), token: "sa-token", client: api.Client()},
+	}
+	image := r.host(t) + "/" + testRepository + ":1.0"
+
+	config, err := source.Lookup(context.Background(), image, "team", []corev1.LocalObjectReference{{Name: "regcred"}})
+	if err != nil {
+		t.Fatalf("Lookup() error = %v", err)
+	}
+	if want := []string{"/amd64-entrypoint"}; !reflect.DeepEqual(config.Entrypoint, want) {
+		t.Errorf("Lookup() entrypoint = %v, want %v", config.Entrypoint, want)
+	}
+
+	_, err = source.Lookup(context.Background(), image, "team", []corev1.LocalObjectReference{{Name: "missing"}})
+	if err == nil || !strings.Contains(err.Error(), "Can't read image pull secret missing: 404") {
+		t.Errorf("Lookup() error = %v, want error reading pull secret", err)
+	}
+
+	_, err = source.Lookup(context.Background(), image, "team", nil)
+	if err == nil || !strings.Contains(err.Error(), "token request to") {
+		t.Errorf("Lookup() without pull secret error = %v, want refused token request", err)
+	}
+}
+
+func TestFixtureImageConfigs(t *testing.T) {
+	f, err := newFixtureImageConfigs("../deployment/image-fixture.example.yaml")
+	if err != nil {
+		t.Fatalf("newFixtureImageConfigs() error = %v", err)
+	}
+	config, err := f.Lookup(context.Background(), "mysql:5.6", "default", nil)
+	if err != nil {
+		t.Fatalf("Lookup() error = %v", err)
+	}
+	want := imageConfig{Entrypoint: []string{"docker-entrypoint.sh"}, Cmd: []string{"mysqld"}}
+	if !reflect.DeepEqual(config, want) {
+		t.Errorf("Lookup() = %+v, want %+v", config, want)
+	}
+	if _, err := f.Lookup(context.Background(), "mysql:8.0", "default", nil); err == nil {
+		t.Error("Lookup() of image missing from fixture succeeded")
+	}
+
+	dir, err := ioutil.TempDir("", "webhook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "fixture.yaml")
+	if err := ioutil.WriteFile(file, []byte("images:\n  \"nginx\":\n    command: [nginx]\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newFixtureImageConfigs(file); err == nil || !strings.Contains(err.Error(), "Error parsing image fixture file") {
+		t.Errorf("newFixtureImageConfigs() with unknown field error = %v", err)
+	}
+}
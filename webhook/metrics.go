@@ -0,0 +1,71 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	metricsNamespace = "centrify"
+	metricsSubsystem = "webhook"
+
+	// Outcomes of admission requests
+	outcomeMutated = "mutated"
+	outcomeSkipped = "skipped"
+	outcomeError   = "error"
+
+	// Reasons why pods are not mutated
+	skipIgnoredNamespace = "ignored_namespace"
+	skipAlreadyInjected  = "already_injected"
+	skipNotRequested     = "not_requested"
+	skipImageLookup      = "image_lookup_failed" // admitted unmodified as onImageLookupFailure of config is "admit"
+)
+
+var (
+	admissionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "admissions_total",
+		Help:      "Number of pod admission requests by namespace and outcome (mutated, skipped or error).",
+	}, []string{"namespace", "outcome"})
+
+	skippedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "skipped_total",
+		Help:      "Number of pods not mutated by reason (ignored_namespace, already_injected, not_requested or image_lookup_failed).",
+	}, []string{"reason"})
+
+	admissionDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "admission_duration_seconds",
+		Help:      "Time taken to answer pod admission requests by outcome, including image registry lookups.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"outcome"})
+
+	patchSize = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "patch_size_bytes",
+		Help:      "Size of JSON patches of mutated pods.",
+		Buckets:   prometheus.ExponentialBuckets(512, 2, 8),
+	})
+)
+
+func init() {
+	prometheus.MustRegister(admissionsTotal, skippedTotal, admissionDuration, patchSize)
+}
+
+// observeAdmission records answered pod admission request. reason is set for skipped pods, patch for mutated ones.
+func observeAdmission(namespace string, outcome string, reason string, duration time.Duration, patch []byte) {
+	admissionsTotal.WithLabelValues(namespace, outcome).Inc()
+	admissionDuration.WithLabelValues(outcome).Observe(duration.Seconds())
+	switch outcome {
+	case outcomeSkipped:
+		skippedTotal.WithLabelValues(reason).Inc()
+	case outcomeMutated:
+		patchSize.Observe(float64(len(patch)))
+	}
+}
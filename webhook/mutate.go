@@ -2,11 +2,13 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"strings"
+	"time"
 
-	"k8s.io/api/admission/v1beta1"
+	"github.com/marcozj/k8s-secret-injection/internal/redact"
+	v1 "k8s.io/api/admission/v1"
 	corev1 "k8s.io/api/core/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/klog"
 )
 
@@ -16,7 +18,11 @@ const (
 	secretVolumeName           = "vault-secret-volume"
 	binVolumeName              = "vault-bin-volume"
 	oauthTokenVolumeName       = "vault-token"
-	oauthTokenPath             = "/var/secrets"
+	oauthTokenPath             = "/var/secrets" // Kubernetes secret holding OAuth token or password is mounted here unless token-file annotation is set
+	saTokenVolumeName          = "vault-sa-token"
+	saTokenPath                = "/var/run/secrets/centrify" // projected ServiceAccount token is mounted here for k8s authentication
+	saTokenExpirationSeconds   = 3600
+	containersDir              = ".containers" // subdirectory of secretsFilesPath holding secrets of each container
 	annotationPrefix           = "vault.centrify.com/"
 	annotationMutate           = annotationPrefix + "mutate"
 	annotationStatus           = annotationPrefix + "status"
@@ -25,23 +31,48 @@ const (
 	annotationAppID            = annotationPrefix + "appid"
 	annotationScope            = annotationPrefix + "scope"
 	annotationToken            = annotationPrefix + "token"
+	annotationTokenFile        = annotationPrefix + "token-file"
+	annotationUser             = annotationPrefix + "user"
+	annotationPasswordFile     = annotationPrefix + "password-file"
+	annotationWorkers          = annotationPrefix + "workers"
+	annotationRetryAttempts    = annotationPrefix + "retry-attempts"
+	annotationRetryDeadline    = annotationPrefix + "retry-deadline"
+	annotationRequestTimeout   = annotationPrefix + "request-timeout"
+	annotationRefreshInterval  = annotationPrefix + "refresh-interval"
+	annotationFileMode         = annotationPrefix + "file-mode"
+	annotationFileUID          = annotationPrefix + "file-uid"
+	annotationFileGID          = annotationPrefix + "file-gid"
+	annotationReadyTimeout     = annotationPrefix + "ready-timeout"
+	annotationEnvCollision     = annotationPrefix + "env-collision"
+	annotationFilesOnly        = annotationPrefix + "files-only"
+	annotationSecretsPath      = annotationPrefix + "secrets-path"
+	annotationContainers       = annotationPrefix + "containers"
+	annotationContainerSecrets = annotationPrefix + "container-secrets-"
+	annotationSupervise        = annotationPrefix + "supervise"
+	annotationOnSecretChange   = annotationPrefix + "on-secret-change"
+	annotationReloadSignal     = annotationPrefix + "reload-signal"
 	annotationOauthSecretName  = annotationPrefix + "oauth-secret-name"
 	annotationEnrollmentCode   = annotationPrefix + "enrollment-code"
 	annotationAuthType         = annotationPrefix + "auth-type"
+	annotationTokenAudience    = annotationPrefix + "token-audience"
+	annotationTokenEndpoint    = annotationPrefix + "token-endpoint"
 	annotationSecretPrefix     = annotationPrefix + "vaultsecret_"
+	annotationTemplatePrefix   = annotationPrefix + "template-"
+	annotationOutput           = annotationPrefix + "output"
+	annotationStrict           = annotationPrefix + "strict"
 	annotationInitContainer    = annotationPrefix + "init-container"
 	annotationSidecarContainer = annotationPrefix + "sidecar-container"
 	annotationInitImage        = annotationPrefix + "init-image"
 	annotationSidecarImage     = annotationPrefix + "sidecar-image"
 )
 
-var ignoredNamespaces = []string{
-	metav1.NamespaceSystem,
-	metav1.NamespacePublic,
-}
-
-func mutatePods(ar v1beta1.AdmissionReview) *v1beta1.AdmissionResponse {
+func mutatePods(ar v1.AdmissionReview) (resp *v1.AdmissionResponse) {
 	klog.Info("mutating pods")
+	start := time.Now()
+	outcome, reason := outcomeError, ""
+	defer func() {
+		observeAdmission(ar.Request.Namespace, outcome, reason, time.Since(start), resp.Patch)
+	}()
 	/*
 		podResource := metav1.GroupVersionResource{Group: "", Version: "v1", Resource: "pods"}
 		if ar.Request.Resource != podResource {
@@ -57,71 +88,85 @@ func mutatePods(ar v1beta1.AdmissionReview) *v1beta1.AdmissionResponse {
 
 	klog.Infof("AdmissionReview for Kind=%v, Namespace=%v (%v) Name=%v UID=%v patchOperation=%v UserInfo=%v",
 		req.Kind, req.Namespace, req.Name, pod.Name, req.UID, req.Operation, req.UserInfo)
-	klog.Infof("Unmarshal pod: %v", pod)
+	// Pod spec is not logged since annotations and env vars may contain tokens, enrollment codes or passwords
+	klog.Infof("Pod annotations: %v", redact.Map(pod.Annotations))
 
 	// Basic admission response without mutation
-	resp := &v1beta1.AdmissionResponse{
+	resp = &v1.AdmissionResponse{
 		Allowed: true,
 		UID:     req.UID,
 	}
 
 	thisPod := myPod{}
 	thisPod.self = &pod
+	thisPod.namespace = req.Namespace
+	thisPod.config = currentWebhookConfig()
+	thisPod.annotations = thisPod.config.filterAnnotations(pod.Annotations)
 	thisPod.injectEnvs = thisPod.convertEnv()
-	thisPod.initContainerImage = "centrify/secret-injector-oauth"
-	thisPod.sideCarContainerImage = "centrify/secret-injector-dmc"
+	thisPod.initContainerImage = thisPod.config.InitImage
+	thisPod.sideCarContainerImage = thisPod.config.SidecarImage
 	// Use custom init image if defined
-	initimage, ok := thisPod.self.Annotations[annotationInitImage]
+	initimage, ok := thisPod.annotations[annotationInitImage]
 	if ok && initimage != "" {
 		thisPod.initContainerImage = initimage
 	}
 	// Use custom sidecar image if defined
-	sidecardimage, ok := thisPod.self.Annotations[annotationSidecarImage]
+	sidecardimage, ok := thisPod.annotations[annotationSidecarImage]
 	if ok && sidecardimage != "" {
 		thisPod.sideCarContainerImage = sidecardimage
 	}
 	// determine whether to perform mutation
-	inject, err := thisPod.mutateRequired(ignoredNamespaces)
+	inject, skipReason, err := thisPod.mutateRequired(thisPod.config.IgnoredNamespaces)
 	if err != nil {
 		return admissionResponseError(err)
 	}
 	if !inject {
 		klog.Infof("Skipping mutation for %s/%s due to policy check", pod.Namespace, pod.Name)
+		outcome, reason = outcomeSkipped, skipReason
 		return resp
 	}
 
 	//annotations := map[string]string{annotationStatus: "injected"}
 	patchBytes, err := thisPod.createPatch()
+	var cmdErr *commandError
+	if errors.As(err, &cmdErr) && thisPod.config.OnImageLookupFailure == imageLookupFailureAdmit {
+		klog.Warningf("Admitting pod %s/%s without secrets: %v", req.Namespace, pod.Name, err)
+		outcome, reason = outcomeSkipped, skipImageLookup
+		return resp
+	}
 	if err != nil {
 		return admissionResponseError(err)
 	}
 
-	klog.Infof("AdmissionResponse: patch=%v\n", string(patchBytes))
+	klog.Infof("AdmissionResponse: patch=%v\n", redact.JSON(patchBytes))
 	resp.Patch = patchBytes
-	patchType := v1beta1.PatchTypeJSONPatch
+	patchType := v1.PatchTypeJSONPatch
 	resp.PatchType = &patchType
+	outcome = outcomeMutated
 
 	return resp
 }
 
-// Check whether the target resoured need to be mutated
-func (p *myPod) mutateRequired(ignoredList []string) (bool, error) {
+// Check whether the target resoured need to be mutated. Reason of skipping is returned unless it needs to be mutated.
+func (p *myPod) mutateRequired(ignoredList []string) (bool, string, error) {
 	klog.Info("Determing if mutation is required...")
 	// skip special kubernete system namespaces
 	for _, namespace := range ignoredList {
 		if p.self.Namespace == namespace {
 			klog.Infof("Skip mutation for %v for it' in special namespace:%v", p.self.Name, p.self.Namespace)
-			return false, nil
+			return false, skipIgnoredNamespace, nil
 		}
 	}
 
 	var mutate bool
-	status, ok := p.self.Annotations[annotationStatus]
+	reason := skipNotRequested
+	status, ok := p.annotations[annotationStatus]
 	if ok && strings.ToLower(status) == "injected" {
 		// status is defined and value is injected, ignore
 		mutate = false
+		reason = skipAlreadyInjected
 	} else {
-		raw, ok := p.self.Annotations[annotationMutate]
+		raw, ok := p.annotations[annotationMutate]
 		if !ok {
 			mutate = false
 		} else {
@@ -129,6 +174,7 @@ func (p *myPod) mutateRequired(ignoredList []string) (bool, error) {
 			switch strings.ToLower(raw) {
 			case "y", "yes", "true", "on":
 				mutate = true
+				reason = ""
 			default:
 				mutate = false
 			}
@@ -136,7 +182,7 @@ func (p *myPod) mutateRequired(ignoredList []string) (bool, error) {
 	}
 
 	klog.Infof("Mutation policy for %v/%v: status: %q required:%v", p.self.Namespace, p.self.Name, status, mutate)
-	return mutate, nil
+	return mutate, reason, nil
 }
 
 // Check whether the target resoured need to be mutated
@@ -181,7 +227,7 @@ func (p *myPod) createPatch() ([]byte, error) {
 	var patch []patchOperation
 
 	// Create init container. Unless specifically indicates no, it should always be created to at least copy app launcher binary
-	init, ok := p.self.Annotations[annotationInitContainer]
+	init, ok := p.annotations[annotationInitContainer]
 	if !(ok && strings.ToLower(init) == "no") {
 		patch = append(patch, p.addInitContainer()...)
 	}
@@ -196,14 +242,22 @@ func (p *myPod) createPatch() ([]byte, error) {
 
 	//patch = append(patch, addEnv(pod.Spec.Containers, envs)...)
 
-	// Mutate container command so that it is launched by app launcher that "inserts" secrets into environment variables within the process
-	applauncher, ok := p.self.Annotations[annotationAppLauncher]
-	if ok && strings.ToLower(applauncher) != "" {
-		patch = append(patch, p.mutateCommand(applauncher)...)
+	// Mutate container command so that it is launched by app launcher that "inserts" secrets into environment variables within the process.
+	// In files-only mode applications read secret files themselves and secrets never appear in their environment.
+	applauncher, ok := p.annotations[annotationAppLauncher]
+	if !ok || applauncher == "" {
+		applauncher = p.config.AppLauncher
+	}
+	if applauncher != "" && !p.filesOnly() {
+		commandPatch, err := p.mutateCommand(applauncher)
+		if err != nil {
+			return nil, err
+		}
+		patch = append(patch, commandPatch...)
 	}
 
 	// Create sidecar container
-	sidecar, ok := p.self.Annotations[annotationSidecarContainer]
+	sidecar, ok := p.annotations[annotationSidecarContainer]
 	if ok && strings.ToLower(sidecar) == "yes" {
 		patch = append(patch, p.addSidecarContainer()...)
 	}
@@ -218,9 +272,13 @@ func (p *myPod) createPatch() ([]byte, error) {
 // convertEnv converts certain annotation into environment variables that to be injected
 func (p *myPod) convertEnv() map[string]string {
 	envs := make(map[string]string)
-	for key, value := range p.self.Annotations {
+	for key, value := range p.annotations {
 		if strings.HasPrefix(key, annotationSecretPrefix) {
 			envs[strings.TrimPrefix(key, annotationSecretPrefix)] = value
+		} else if strings.HasPrefix(key, annotationContainerSecrets) {
+			envs["VAULT_CONTAINER_SECRETS_"+strings.TrimPrefix(key, annotationContainerSecrets)] = value
+		} else if strings.HasPrefix(key, annotationTemplatePrefix) {
+			envs["VAULT_TEMPLATE_"+strings.TrimPrefix(key, annotationTemplatePrefix)] = value
 		} else {
 			switch key {
 			case annotationTenanturl:
@@ -231,13 +289,57 @@ func (p *myPod) convertEnv() map[string]string {
 				envs["VAULT_SCOPE"] = value
 			case annotationToken:
 				envs["VAULT_TOKEN"] = value
+			case annotationTokenFile:
+				envs["VAULT_TOKEN_FILE"] = value
 			case annotationAuthType:
-				envs["VAULT_AUTHTYPE"] = value
+				envs["VAULT_AUTHTYPE"] = strings.ToLower(value)
+			case annotationTokenEndpoint:
+				envs["VAULT_TOKEN_ENDPOINT"] = value
 			case annotationEnrollmentCode:
 				envs["VAULT_ENROLLMENTCODE"] = value
+			case annotationUser:
+				envs["VAULT_USER"] = value
+			case annotationPasswordFile:
+				envs["VAULT_PASSWORD_FILE"] = value
+			case annotationWorkers:
+				envs["VAULT_WORKERS"] = value
+			case annotationRetryAttempts:
+				envs["VAULT_RETRY_ATTEMPTS"] = value
+			case annotationRetryDeadline:
+				envs["VAULT_RETRY_DEADLINE"] = value
+			case annotationRequestTimeout:
+				envs["VAULT_REQUEST_TIMEOUT"] = value
+			case annotationRefreshInterval:
+				envs["VAULT_WATCH_INTERVAL"] = value
+			case annotationFileMode:
+				envs["VAULT_FILE_MODE"] = value
+			case annotationFileUID:
+				envs["VAULT_FILE_UID"] = value
+			case annotationFileGID:
+				envs["VAULT_FILE_GID"] = value
+			case annotationOutput:
+				envs["VAULT_OUTPUT"] = value
+			case annotationStrict:
+				envs["VAULT_STRICT"] = value
 			}
 		}
 	}
 
+	// Tenant and authentication type default to config. Authentication type is lowercased as injector expects it
+	if envs["VAULT_URL"] == "" && p.config.TenantURL != "" {
+		envs["VAULT_URL"] = p.config.TenantURL
+	}
+	if envs["VAULT_AUTHTYPE"] == "" && p.config.AuthType != "" {
+		envs["VAULT_AUTHTYPE"] = strings.ToLower(p.config.AuthType)
+	}
+	if envs["VAULT_TOKEN_ENDPOINT"] == "" && p.config.TokenEndpoint != "" {
+		envs["VAULT_TOKEN_ENDPOINT"] = p.config.TokenEndpoint
+	}
+
+	// Password for unpw authentication is read from the mounted Kubernetes secret unless specified otherwise
+	if envs["VAULT_AUTHTYPE"] == "unpw" && envs["VAULT_PASSWORD_FILE"] == "" {
+		envs["VAULT_PASSWORD_FILE"] = p.tokenPath() + "/password"
+	}
+
 	return envs
 }
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestConvertEnvAuthType(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		config      webhookConfig
+		authType    string
+		k8s         bool
+		hasPassword bool
+	}{
+		{
+			name:        "k8s in upper case",
+			annotations: map[string]string{annotationAuthType: "K8S"},
+			authType:    "k8s",
+			k8s:         true,
+		},
+		{
+			name:     "k8s from config",
+			config:   webhookConfig{AuthType: "K8s"},
+			authType: "k8s",
+			k8s:      true,
+		},
+		{
+			name:        "unpw in mixed case",
+			annotations: map[string]string{annotationAuthType: "UnPw"},
+			authType:    "unpw",
+			hasPassword: true,
+		},
+		{
+			name:        "annotation overrides config",
+			annotations: map[string]string{annotationAuthType: "OAuth"},
+			config:      webhookConfig{AuthType: "k8s"},
+			authType:    "oauth",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &myPod{annotations: tt.annotations, config: &tt.config}
+			p.injectEnvs = p.convertEnv()
+			if got := p.injectEnvs["VAULT_AUTHTYPE"]; got != tt.authType {
+				t.Errorf("VAULT_AUTHTYPE = %q, want %q", got, tt.authType)
+			}
+			if got := p.isServiceAccountAuth(); got != tt.k8s {
+				t.Errorf("isServiceAccountAuth() = %v, want %v", got, tt.k8s)
+			}
+			if _, got := p.injectEnvs["VAULT_PASSWORD_FILE"]; got != tt.hasPassword {
+				t.Errorf("VAULT_PASSWORD_FILE is set = %v, want %v", got, tt.hasPassword)
+			}
+		})
+	}
+}
+
+// TestSidecarEnv checks that sidecar container gets the same options as init container, so that refreshed
+// secret files are written like the ones the pod started with
+func TestSidecarEnv(t *testing.T) {
+	pod := testPod(map[string]string{
+		annotationSidecarContainer:         "yes",
+		annotationRefreshInterval:          "5m",
+		annotationFileMode:                 "0600",
+		annotationOutput:                   "dotenv",
+		annotationStrict:                   "no",
+		annotationContainerSecrets + "app": "DB_PASSWORD",
+	})
+	p := &myPod{self: pod, config: &webhookConfig{}, annotations: pod.Annotations}
+	p.injectEnvs = p.convertEnv()
+
+	env := func(patch []patchOperation) map[string]string {
+		t.Helper()
+		if len(patch) != 1 {
+			t.Fatalf("patch = %+v, want one operation", patch)
+		}
+		var c corev1.Container
+		switch v := patch[0].Value.(type) {
+		case corev1.Container:
+			c = v
+		case []corev1.Container:
+			c = v[0]
+		default:
+			t.Fatalf("patch value is %T", v)
+		}
+		result := make(map[string]string)
+		for _, e := range c.Env {
+			result[e.Name] = e.Value
+		}
+		return result
+	}
+	initEnv := env(p.addInitContainer())
+	sidecarEnv := env(p.addSidecarContainer())
+
+	if _, ok := initEnv["VAULT_WATCH_INTERVAL"]; ok {
+		t.Error("init container refreshes secrets")
+	}
+	if sidecarEnv["VAULT_WATCH_INTERVAL"] != "5m" {
+		t.Errorf("sidecar VAULT_WATCH_INTERVAL = %q, want 5m", sidecarEnv["VAULT_WATCH_INTERVAL"])
+	}
+	delete(sidecarEnv, "VAULT_WATCH_INTERVAL")
+	if !reflect.DeepEqual(sidecarEnv, initEnv) {
+		t.Errorf("sidecar env = %v, want env of init container %v", sidecarEnv, initEnv)
+	}
+	for _, name := range []string{"VAULT_FILE_MODE", "VAULT_OUTPUT", "VAULT_STRICT", "VAULT_CONTAINER_SECRETS_app", "VAULT_TEMPLATE_config.yaml", "DB_PASSWORD"} {
+		if _, ok := initEnv[name]; !ok {
+			t.Errorf("init container has no %s: %v", name, initEnv)
+		}
+	}
+}
+
+func TestMutateCommand(t *testing.T) {
+	defer func(source imageConfigSource) { imageConfigs = source }(imageConfigs)
+	imageConfigs = &fixtureImageConfigs{Images: map[string]imageConfig{
+		"nginx:1.19": {Entrypoint: []string{"/docker-entrypoint.sh"}, Cmd: []string{"nginx", "-g", "daemon off;"}},
+	}}
+
+	tests := []struct {
+		name      string
+		container corev1.Container
+		argv      []string // command and args that Kubernetes runs after mutation
+		err       string
+	}{
+		{
+			name:      "args without command",
+			container: corev1.Container{Name: "app", Image: "nginx:1.19", Args: []string{"nginx", "-T"}},
+			argv:      []string{"/centrify/bin/launcher", "/docker-entrypoint.sh", "nginx", "-T"},
+		},
+		{
+			name:      "neither command nor args",
+			container: corev1.Container{Name: "app", Image: "nginx:1.19"},
+			argv:      []string{"/centrify/bin/launcher", "/docker-entrypoint.sh", "nginx", "-g", "daemon off;"},
+		},
+		{
+			name:      "command and args",
+			container: corev1.Container{Name: "app", Image: "unknown:1.0", Command: []string{"/app"}, Args: []string{"-v"}},
+			argv:      []string{"/centrify/bin/launcher", "/app", "-v"},
+		},
+		{
+			name:      "unknown image",
+			container: corev1.Container{Name: "app", Image: "unknown:1.0", Args: []string{"-v"}},
+			err:       "Can't determine command of container app",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := testPod(nil)
+			pod.Spec.Containers = []corev1.Container{tt.container}
+			p := &myPod{self: pod, config: &webhookConfig{}, annotations: pod.Annotations}
+			patch, err := p.mutateCommand("/centrify/bin/launcher")
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("mutateCommand() error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("mutateCommand() error = %v", err)
+			}
+
+			// Apply patch the way API server does, "add" sets a member whether or not it exists
+			values := make(map[string][]string)
+			for _, op := range patch {
+				if op.Op != "add" {
+					t.Errorf("unexpected %s operation on %s", op.Op, op.Path)
+				}
+				values[op.Path] = op.Value.([]string)
+			}
+			if len(values) != 2 {
+				t.Fatalf("patch = %+v, want command and args", patch)
+			}
+			argv := append(values["/spec/containers/0/command"], values["/spec/containers/0/args"]...)
+			if !reflect.DeepEqual(argv, tt.argv) {
+				t.Errorf("container runs %q, want %q", argv, tt.argv)
+			}
+		})
+	}
+}
+
+func TestMutatePodsImageLookupFailure(t *testing.T) {
+	defer func(source imageConfigSource) { imageConfigs = source }(imageConfigs)
+	imageConfigs = &fixtureImageConfigs{}
+	defer setWebhookConfig(currentWebhookConfig())
+
+	pod := testPod(nil)
+	pod.Spec.Containers = []corev1.Container{{Name: "app", Image: "private.example.com/app:1.0"}}
+	raw, err := json.Marshal(pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ar := v1.AdmissionReview{Request: &v1.AdmissionRequest{UID: "uid", Namespace: "team", Object: runtime.RawExtension{Raw: raw}}}
+
+	tests := []struct {
+		policy  string
+		allowed bool
+	}{
+		{policy: "", allowed: false},
+		{policy: imageLookupFailureDeny, allowed: false},
+		{policy: imageLookupFailureAdmit, allowed: true},
+	}
+	for _, tt := range tests {
+		t.Run("onImageLookupFailure "+tt.policy, func(t *testing.T) {
+			config := defaultWebhookConfig()
+			config.AppLauncher = "/centrify/bin/launcher"
+			config.OnImageLookupFailure = tt.policy
+			setWebhookConfig(config)
+
+			resp := mutatePods(ar)
+			if resp.Allowed != tt.allowed {
+				t.Fatalf("pod allowed = %v, want %v: %+v", resp.Allowed, tt.allowed, resp.Result)
+			}
+			if resp.Patch != nil {
+				t.Errorf("pod is mutated: %s", resp.Patch)
+			}
+			if !tt.allowed && (resp.Result == nil || !strings.Contains(resp.Result.Message, "Can't determine command of container app")) {
+				t.Errorf("denied with %+v, want error naming container", resp.Result)
+			}
+		})
+	}
+}
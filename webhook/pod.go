@@ -1,8 +1,11 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"path"
 	"strconv"
+	"strings"
 
 	"github.com/golang/glog"
 	corev1 "k8s.io/api/core/v1"
@@ -11,6 +14,9 @@ import (
 
 type myPod struct {
 	self                  *corev1.Pod
+	annotations           map[string]string // annotations of pod that are allowed by config
+	config                *webhookConfig
+	namespace             string // namespace of admission request, since it may be missing from pod
 	injectEnvs            map[string]string
 	initContainerImage    string
 	sideCarContainerImage string
@@ -35,16 +41,16 @@ func (p *myPod) addInitContainer() (patch []patchOperation) {
 			MountPath: binPath,
 			ReadOnly:  false,
 		},
-		{
-			Name:      oauthTokenVolumeName,
-			MountPath: oauthTokenPath,
-			ReadOnly:  true,
-		},
+		p.tokenVolumeMount(),
 	}
 
 	// Add environment variables for communicating with the tenant
 	var envVars []corev1.EnvVar
 	for key, value := range p.injectEnvs {
+		// Init container must exit, so only sidecar container keeps refreshing secrets
+		if key == "VAULT_WATCH_INTERVAL" {
+			continue
+		}
 		var envVar corev1.EnvVar
 		envVar.Name = key
 		envVar.Value = value
@@ -57,7 +63,8 @@ func (p *myPod) addInitContainer() (patch []patchOperation) {
 	newContainer := corev1.Container{
 		Name:            "centrifyk8s-init",
 		Image:           p.initContainerImage,
-		ImagePullPolicy: "IfNotPresent",
+		ImagePullPolicy: p.config.ImagePullPolicy,
+		Resources:       p.config.InitResources,
 		Env:             envVars,
 		VolumeMounts:    volumeMounts,
 	}
@@ -77,11 +84,7 @@ func (p *myPod) addSidecarContainer() (patch []patchOperation) {
 			MountPath: binPath,
 			ReadOnly:  false,
 		},
-		{
-			Name:      oauthTokenVolumeName,
-			MountPath: oauthTokenPath,
-			ReadOnly:  true,
-		},
+		p.tokenVolumeMount(),
 	}
 
 	// Add environment variables for communicating with the tenant
@@ -99,7 +102,8 @@ func (p *myPod) addSidecarContainer() (patch []patchOperation) {
 	newContainer := corev1.Container{
 		Name:            "centrifyk8s-sidecar",
 		Image:           p.sideCarContainerImage,
-		ImagePullPolicy: "IfNotPresent",
+		ImagePullPolicy: p.config.ImagePullPolicy,
+		Resources:       p.config.SidecarResources,
 		Env:             envVars,
 		VolumeMounts:    volumeMounts,
 		//Command:         []string{"/bin/sh", "-c"},
@@ -133,7 +137,11 @@ func (p *myPod) addVolume() (patch []patchOperation) {
 }
 
 func (p *myPod) addSecretVolume() (patch []patchOperation) {
-	secretName, ok := p.self.Annotations[annotationOauthSecretName]
+	// ServiceAccount token replaces the Kubernetes secret holding OAuth2 token or password
+	if p.isServiceAccountAuth() {
+		return addVolumes(p.self.Spec.Volumes, []corev1.Volume{p.saTokenVolume()}, "/spec/volumes")
+	}
+	secretName, ok := p.annotations[annotationOauthSecretName]
 	if ok && secretName != "" {
 		secretVolume := corev1.Volume{
 			Name: secretName,
@@ -148,10 +156,69 @@ func (p *myPod) addSecretVolume() (patch []patchOperation) {
 	return patch
 }
 
+// isServiceAccountAuth tells whether injector authenticates with projected ServiceAccount token of the pod
+func (p *myPod) isServiceAccountAuth() bool {
+	return p.injectEnvs["VAULT_AUTHTYPE"] == "k8s"
+}
+
+// saTokenVolume returns projected volume holding ServiceAccount token of the pod issued for token audience,
+// which defaults to tenant URL. Kubelet rotates the token before it expires.
+func (p *myPod) saTokenVolume() corev1.Volume {
+	audience := p.annotations[annotationTokenAudience]
+	if audience == "" {
+		audience = p.config.TokenAudience
+	}
+	if audience == "" {
+		audience = p.injectEnvs["VAULT_URL"]
+	}
+	expiration := int64(saTokenExpirationSeconds)
+	return corev1.Volume{
+		Name: saTokenVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			Projected: &corev1.ProjectedVolumeSource{
+				Sources: []corev1.VolumeProjection{
+					{
+						ServiceAccountToken: &corev1.ServiceAccountTokenProjection{
+							Audience:          audience,
+							ExpirationSeconds: &expiration,
+							Path:              "token",
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// tokenVolumeMount returns mount of the volume that init and sidecar containers authenticate with
+func (p *myPod) tokenVolumeMount() corev1.VolumeMount {
+	if p.isServiceAccountAuth() {
+		return corev1.VolumeMount{
+			Name:      saTokenVolumeName,
+			MountPath: saTokenPath,
+			ReadOnly:  true,
+		}
+	}
+	return corev1.VolumeMount{
+		Name:      oauthTokenVolumeName,
+		MountPath: p.tokenPath(),
+		ReadOnly:  true,
+	}
+}
+
+// tokenPath returns directory that Kubernetes secret holding OAuth token or password is mounted at.
+// It is the directory of token-file annotation if set, so that the token file is a key of the secret.
+func (p *myPod) tokenPath() string {
+	if tokenFile := p.annotations[annotationTokenFile]; tokenFile != "" {
+		return path.Dir(tokenFile)
+	}
+	return oauthTokenPath
+}
+
 func (p *myPod) addVolumeMount() (patch []patchOperation) {
 	secretVolumeMount := corev1.VolumeMount{
 		Name:      secretVolumeName,
-		MountPath: secretsFilesPath,
+		MountPath: p.secretsPath(),
 		ReadOnly:  false,
 	}
 	binVolumeMount := corev1.VolumeMount{
@@ -159,17 +226,61 @@ func (p *myPod) addVolumeMount() (patch []patchOperation) {
 		MountPath: binPath,
 		ReadOnly:  false,
 	}
+	mounts := []corev1.VolumeMount{secretVolumeMount, binVolumeMount}
+	if p.filesOnly() {
+		// App launcher isn't used
+		mounts = []corev1.VolumeMount{secretVolumeMount}
+	}
 
 	for i, container := range p.self.Spec.Containers {
+		if !p.isTargetContainer(container.Name) {
+			continue
+		}
+		containerMounts := mounts
+		if _, ok := p.annotations[annotationContainerSecrets+container.Name]; ok {
+			// Container only sees the subdirectory that secret injector writes its subset of secrets to
+			containerMounts = append([]corev1.VolumeMount{}, mounts...)
+			containerMounts[0].SubPath = containersDir + "/" + container.Name
+		}
 		patch = append(patch, addVolumeMounts(
 			container.VolumeMounts,
-			[]corev1.VolumeMount{secretVolumeMount, binVolumeMount},
+			containerMounts,
 			fmt.Sprintf("/spec/containers/%d/volumeMounts", i))...)
 	}
 
 	return patch
 }
 
+// filesOnly tells whether secrets are only exposed as files, without app launcher injecting them into environment variables
+func (p *myPod) filesOnly() bool {
+	filesOnly, ok := p.annotations[annotationFilesOnly]
+	return ok && strings.ToLower(filesOnly) == "yes"
+}
+
+// secretsPath returns path that secret files are mounted at in application containers
+func (p *myPod) secretsPath() string {
+	path, ok := p.annotations[annotationSecretsPath]
+	if ok && path != "" {
+		return path
+	}
+	return secretsFilesPath
+}
+
+// isTargetContainer tells whether secrets are injected into application container name.
+// All containers are targeted unless they are listed in containers annotation.
+func (p *myPod) isTargetContainer(name string) bool {
+	containers, ok := p.annotations[annotationContainers]
+	if !ok || strings.TrimSpace(containers) == "" {
+		return true
+	}
+	for _, c := range strings.Split(containers, ",") {
+		if strings.TrimSpace(c) == name {
+			return true
+		}
+	}
+	return false
+}
+
 func addSecretVolumeMount(target []corev1.Container, secretName string) (patch []patchOperation) {
 	secretVolumeMount := corev1.VolumeMount{
 		Name:      secretName,
@@ -187,37 +298,114 @@ func addSecretVolumeMount(target []corev1.Container, secretName string) (patch [
 	return patch
 }
 
-func (p *myPod) mutateCommand(launcherPath string) (patch []patchOperation) {
+// commandError tells that command of a container can't be determined from its image
+type commandError struct {
+	container string
+	err       error
+}
+
+func (e *commandError) Error() string {
+	return fmt.Sprintf("Can't determine command of container %s: %v", e.container, e.err)
+}
+
+func (p *myPod) mutateCommand(launcherPath string) (patch []patchOperation, err error) {
+	// All image lookups of the pod share one deadline so that admission is answered before webhook timeout
+	ctx, cancel := context.WithTimeout(context.Background(), imageLookupTimeout)
+	defer cancel()
 	for i, container := range p.self.Spec.Containers {
+		if !p.isTargetContainer(container.Name) {
+			continue
+		}
 		// https://kubernetes.io/docs/tasks/inject-data-application/define-command-argument-container/#notes
 		args := container.Command
 		// the container has no explicitly specified command
 		if len(args) == 0 {
 			// Get container image entrypoint
-			envs := container.Env
-			for _, env := range envs {
-				if env.Name == "CFYVAULT_CONTAINER_ENTRYPOINT" {
-					args = append(args, env.Value)
-				} else if env.Name == "CFYVAULT_CONTAINER_CMD" && len(container.Args) == 0 {
-					// If no Args are defined we can use the Docker CMD from the image
-					args = append(args, env.Value)
-				}
+			config, err := p.imageConfig(ctx, container)
+			if err != nil {
+				return nil, &commandError{container: container.Name, err: err}
+			}
+			args = append(args, config.Entrypoint...)
+			if len(container.Args) == 0 {
+				// If no Args are defined we can use the Docker CMD from the image
+				args = append(args, config.Cmd...)
 			}
 		}
 
 		args = append(args, container.Args...)
-		container.Command = []string{launcherPath}
+		if len(args) == 0 {
+			return nil, &commandError{container: container.Name, err: fmt.Errorf("image %s has neither entrypoint nor cmd", container.Image)}
+		}
+		container.Command = append([]string{launcherPath}, p.launcherArgs()...)
 		container.Args = args
 		klog.Infof("Final container command and args: %v %v", container.Command, container.Args)
 
+		// Kubernetes runs command followed by args, so the original args are moved into args after the original command.
+		// "add" replaces a member that exists, and unlike "replace" also works if the container has none.
 		patch = append(patch, patchOperation{
-			Op:    "replace",
+			Op:    "add",
 			Path:  fmt.Sprintf("/spec/containers/%d/command", i),
-			Value: append(container.Command, container.Args...),
+			Value: container.Command,
+		}, patchOperation{
+			Op:    "add",
+			Path:  fmt.Sprintf("/spec/containers/%d/args", i),
+			Value: container.Args,
 		})
 	}
 
-	return patch
+	return patch, nil
+}
+
+// imageConfig returns entrypoint and cmd of container image. CFYVAULT_CONTAINER_ENTRYPOINT and CFYVAULT_CONTAINER_CMD
+// env vars of the container take precedence over image configuration looked up from registry.
+func (p *myPod) imageConfig(ctx context.Context, container corev1.Container) (imageConfig, error) {
+	var config imageConfig
+	for _, env := range container.Env {
+		if env.Name == "CFYVAULT_CONTAINER_ENTRYPOINT" {
+			config.Entrypoint = []string{env.Value}
+		} else if env.Name == "CFYVAULT_CONTAINER_CMD" {
+			config.Cmd = []string{env.Value}
+		}
+	}
+	if len(config.Entrypoint) > 0 || len(config.Cmd) > 0 || imageConfigs == nil {
+		return config, nil
+	}
+
+	config, err := imageConfigs.Lookup(ctx, container.Image, p.namespace, p.self.Spec.ImagePullSecrets)
+	if err != nil {
+		return config, err
+	}
+	klog.Infof("Image %s has entrypoint %v and cmd %v", container.Image, config.Entrypoint, config.Cmd)
+	return config, nil
+}
+
+// launcherArgs returns options of app launcher that are configured by annotations.
+// They are placed before the original command, which ends option parsing of app launcher.
+func (p *myPod) launcherArgs() (args []string) {
+	if path := p.secretsPath(); path != secretsFilesPath {
+		args = append(args, "-secrets-dir="+path)
+	}
+	timeout, ok := p.annotations[annotationReadyTimeout]
+	if ok && timeout != "" {
+		args = append(args, "-ready-timeout="+timeout)
+	}
+	collision, ok := p.annotations[annotationEnvCollision]
+	if ok && collision != "" {
+		args = append(args, "-on-collision="+collision)
+	}
+	supervise, ok := p.annotations[annotationSupervise]
+	if ok && strings.ToLower(supervise) == "yes" {
+		args = append(args, "-supervise")
+	}
+	onChange, ok := p.annotations[annotationOnSecretChange]
+	if ok && onChange != "" {
+		args = append(args, "-on-change="+onChange)
+	}
+	signal, ok := p.annotations[annotationReloadSignal]
+	if ok && signal != "" {
+		args = append(args, "-reload-signal="+signal)
+	}
+	return args
 }
 
 //////////////////////////////
@@ -238,7 +426,7 @@ func addEnv(target []corev1.Container, envs map[string]string) (patch []patchOpe
 	}
 
 	for x := 0; x < (len(target)); x++ {
-		klog.Infof("Processing Container %v With Existing EnvVars:%v", x, target[x].Env)
+		klog.Infof("Processing Container %v With %d Existing EnvVars", x, len(target[x].Env))
 
 		if target[x].Env == nil {
 			addenvdef = true
@@ -252,7 +440,7 @@ func addEnv(target []corev1.Container, envs map[string]string) (patch []patchOpe
 		if addenvdef {
 			path = path + strconv.Itoa(x) + "/env"
 			value = envVars
-			klog.Infof("No EnvVars Set ... adding array to PATH === %v  &&  VALUE =======:%v", path, value)
+			klog.Infof("No EnvVars Set ... adding array to PATH === %v", path)
 			patch = append(patch, patchOperation{
 				Op:    "add",
 				Path:  path,
@@ -262,7 +450,7 @@ func addEnv(target []corev1.Container, envs map[string]string) (patch []patchOpe
 			path = path + strconv.Itoa(x) + "/env/-"
 			for _, add := range envVars {
 				value = add
-				glog.Infof("Injecting PATH === %v  &&  VALUE =======:%v", path, value)
+				glog.Infof("Injecting PATH === %v  &&  NAME =======:%v", path, add.Name)
 				patch = append(patch, patchOperation{
 					Op:    "add",
 					Path:  path,
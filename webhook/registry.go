@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+)
+
+const (
+	dockerHubDomain   = "docker.io"
+	dockerHubRegistry = "registry-1.docker.io"
+	defaultPlatform   = "linux/amd64"
+	defaultTag        = "latest"
+
+	mediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeOCIManifest        = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeOCIIndex           = "application/vnd.oci.image.index.v1+json"
+)
+
+// imageConfig is the part of image configuration that determines the command of a container
+type imageConfig struct {
+	Entrypoint []string `json:"Entrypoint"`
+	Cmd        []string `json:"Cmd"`
+}
+
+// imageRef is a parsed image reference such as "registry.example.com:5000/team/app:1.0@sha256:..."
+type imageRef struct {
+	domain     string // registry as written in image reference, "docker.io" if omitted
+	registry   string // host that serves registry API
+	repository string
+	tag        string
+	digest     string
+}
+
+// registryCredentials are credentials of a registry taken from image pull secrets
+type registryCredentials struct {
+	username string
+	password string
+}
+
+// registryClient looks up image configuration with registry HTTP API V2. Configurations are cached by manifest digest
+// and the credentials they were read with.
+type registryClient struct {
+	client   *http.Client
+	insecure map[string]bool // registries accessed over plain HTTP, such as a local registry
+	platform string          // platform selected from multi-platform images, for example "linux/amd64"
+
+	mu    sync.Mutex
+	cache map[string]imageConfig
+}
+
+func newRegistryClient(timeout time.Duration, insecure []string, platform string) *registryClient {
+	c := &registryClient{
+		client:   &http.Client{Timeout: timeout},
+		insecure: make(map[string]bool),
+		platform: platform,
+		cache:    make(map[string]imageConfig),
+	}
+	for _, r := range insecure {
+		if r = strings.TrimSpace(r); r != "" {
+			c.insecure[r] = true
+		}
+	}
+	return c
+}
+
+// parseImageRef parses image reference of a container
+func parseImageRef(image string) (imageRef, error) {
+	ref := imageRef{domain: dockerHubDomain}
+	name := image
+	if idx := strings.Index(name, "@"); idx >= 0 {
+		ref.digest = name[idx+1:]
+		name = name[:idx]
+	}
+	if idx := strings.LastIndex(name, ":"); idx > strings.LastIndex(name, "/") {
+		ref.tag = name[idx+1:]
+		name = name[:idx]
+	}
+	if idx := strings.Index(name, "/"); idx >= 0 {
+		first := name[:idx]
+		if strings.ContainsAny(first, ".:") || first == "localhost" {
+			ref.domain = first
+			name = name[idx+1:]
+		}
+	}
+	if name == "" {
+		return ref, fmt.Errorf("invalid image reference %s", image)
+	}
+	ref.registry = ref.domain
+	if ref.domain == dockerHubDomain {
+		ref.registry = dockerHubRegistry
+		if !strings.Contains(name, "/") {
+			name = "library/" + name
+		}
+	}
+	ref.repository = name
+	if ref.tag == "" && ref.digest == "" {
+		ref.tag = defaultTag
+	}
+	return ref, nil
+}
+
+// lookup returns configuration of image
+func (c *registryClient) lookup(ctx context.Context, ref imageRef, creds *registryCredentials) (imageConfig, error) {
+	digest := ref.digest
+	if digest == "" {
+		var err error
+		if digest, err = c.manifestDigest(ctx, ref, creds); err != nil {
+			return imageConfig{}, err
+		}
+	}
+
+	c.mu.Lock()
+	config, ok := c.cache[cacheKey(ref, digest, creds)]
+	if !ok {
+		// Configuration read anonymously is public
+		config, ok = c.cache[cacheKey(ref, digest, nil)]
+	}
+	c.mu.Unlock()
+	if ok {
+		return config, nil
+	}
+
+	config, err := c.fetchConfig(ctx, ref, digest, creds)
+	if err != nil {
+		return imageConfig{}, err
+	}
+	c.mu.Lock()
+	c.cache[cacheKey(ref, digest, creds)] = config
+	c.mu.Unlock()
+	return config, nil
+}
+
+// cacheKey identifies configuration of image with manifest digest as read with creds. Configuration read with
+// credentials is only served to lookups with the same credentials, so that a pod can't learn the command of a
+// private image through a pull secret of another namespace.
+func cacheKey(ref imageRef, digest string, creds *registryCredentials) string {
+	key := ref.registry + "/" + ref.repository + "@" + digest
+	if creds != nil {
+		sum := sha256.Sum256([]byte(creds.username + "\x00" + creds.password))
+		key += " " + hex.EncodeToString(sum[:])
+	}
+	return key
+}
+
+// manifestDigest resolves tag of image to digest of its manifest
+func (c *registryClient) manifestDigest(ctx context.Context, ref imageRef, creds *registryCredentials) (string, error) {
+	resp, err := c.get(ctx, ref, "HEAD", "manifests/"+ref.tag, creds)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if digest := resp.Header.Get("Docker-Content-Digest"); digest != "" {
+		return digest, nil
+	}
+
+	// Not every registry returns digest for HEAD requests
+	resp, err = c.get(ctx, ref, "GET", "manifests/"+ref.tag, creds)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if digest := resp.Header.Get("Docker-Content-Digest"); digest != "" {
+		return digest, nil
+	}
+	sum := sha256.Sum256(body)
+	return "sha256:" + hex.EncodeToString(sum[:]), nil
+}
+
+// fetchConfig reads manifest with digest, selecting platform of multi-platform images, then reads image configuration it refers to
+func (c *registryClient) fetchConfig(ctx context.Context, ref imageRef, digest string, creds *registryCredentials) (imageConfig, error) {
+	var manifest struct {
+		MediaType string `json:"mediaType"`
+		Config    struct {
+			Digest string `json:"digest"`
+		} `json:"config"`
+		Manifests []struct {
+			Digest   string `json:"digest"`
+			Platform struct {
+				OS           string `json:"os"`
+				Architecture string `json:"architecture"`
+			} `json:"platform"`
+		} `json:"manifests"`
+	}
+	if err := c.getJSON(ctx, ref, "manifests/"+digest, creds, &manifest); err != nil {
+		return imageConfig{}, err
+	}
+
+	if manifest.MediaType == mediaTypeDockerManifestList || manifest.MediaType == mediaTypeOCIIndex || len(manifest.Manifests) > 0 {
+		for _, m := range manifest.Manifests {
+			if m.Platform.OS+"/"+m.Platform.Architecture == c.platform {
+				return c.fetchConfig(ctx, ref, m.Digest, creds)
+			}
+		}
+		return imageConfig{}, fmt.Errorf("image %s has no manifest for platform %s", ref.repository, c.platform)
+	}
+	if manifest.Config.Digest == "" {
+		return imageConfig{}, fmt.Errorf("unsupported manifest type %q of image %s", manifest.MediaType, ref.repository)
+	}
+
+	var config struct {
+		Config imageConfig `json:"config"`
+	}
+	if err := c.getJSON(ctx, ref, "blobs/"+manifest.Config.Digest, creds, &config); err != nil {
+		return imageConfig{}, err
+	}
+	return config.Config, nil
+}
+
+func (c *registryClient) getJSON(ctx context.Context, ref imageRef, path string, creds *registryCredentials, v interface{}) error {
+	resp, err := c.get(ctx, ref, "GET", path, creds)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// get sends request to registry API of image repository, authenticating with basic or bearer token authentication if challenged
+func (c *registryClient) get(ctx context.Context, ref imageRef, method string, path string, creds *registryCredentials) (*http.Response, error) {
+	scheme := "https"
+	if c.insecure[ref.domain] {
+		scheme = "http"
+	}
+	u := fmt.Sprintf("%s://%s/v2/%s/%s", scheme, ref.registry, ref.repository, path)
+
+	var authorization string
+	for attempt := 0; attempt < 2; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, method, u, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", strings.Join([]string{mediaTypeDockerManifest, mediaTypeDockerManifestList, mediaTypeOCIManifest, mediaTypeOCIIndex}, ", "))
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		resp, err := c.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusUnauthorized && authorization == "" {
+			challenge := resp.Header.Get("WWW-Authenticate")
+			resp.Body.Close()
+			if authorization, err = c.authorize(ctx, challenge, ref, creds); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("%s %s: %s", method, u, resp.Status)
+		}
+		return resp, nil
+	}
+	return nil, fmt.Errorf("%s %s: unauthorized", method, u)
+}
+
+// authorize returns Authorization header answering WWW-Authenticate challenge of registry
+func (c *registryClient) authorize(ctx context.Context, challenge string, ref imageRef, creds *registryCredentials) (string, error) {
+	scheme, params := parseChallenge(challenge)
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if creds == nil {
+			return "", fmt.Errorf("registry %s requires credentials, add an image pull secret and enable -readPullSecrets, or set command of the container", ref.domain)
+		}
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(creds.username+":"+creds.password)), nil
+	case "bearer":
+		query := url.Values{}
+		if params["service"] != "" {
+			query.Set("service", params["service"])
+		}
+		query.Set("scope", "repository:"+ref.repository+":pull")
+		req, err := http.NewRequestWithContext(ctx, "GET", params["realm"]+"?"+query.Encode(), nil)
+		if err != nil {
+			return "", err
+		}
+		if creds != nil {
+			req.SetBasicAuth(creds.username, creds.password)
+		}
+		resp, err := c.client.Do(req)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("token request to %s: %s", params["realm"], resp.Status)
+		}
+		var token struct {
+			Token       string `json:"token"`
+			AccessToken string `json:"access_token"`
+		}
+		if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&token); err != nil {
+			return "", err
+		}
+		if token.Token == "" {
+			token.Token = token.AccessToken
+		}
+		return "Bearer " + token.Token, nil
+	}
+	return "", fmt.Errorf("registry %s requires unsupported authentication %q", ref.domain, challenge)
+}
+
+// parseChallenge parses WWW-Authenticate header such as `Bearer realm="https://auth.docker.io/token",service="registry.docker.io"`
+func parseChallenge(challenge string) (string, map[string]string) {
+	params := make(map[string]string)
+	split := strings.SplitN(strings.TrimSpace(challenge), " ", 2)
+	if len(split) == 2 {
+		for _, p := range strings.Split(split[1], ",") {
+			kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+			if len(kv) == 2 {
+				params[strings.ToLower(kv[0])] = strings.Trim(kv[1], `"`)
+			}
+		}
+	}
+	klog.V(2).Infof("Registry challenge %s %v", split[0], params)
+	return split[0], params
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseImageRef(t *testing.T) {
+	tests := []struct {
+		image string
+		want  imageRef
+		err   bool
+	}{
+		{
+			image: "nginx",
+			want:  imageRef{domain: "docker.io", registry: "registry-1.docker.io", repository: "library/nginx", tag: "latest"},
+		},
+		{
+			image: "nginx:1.19",
+			want:  imageRef{domain: "docker.io", registry: "registry-1.docker.io", repository: "library/nginx", tag: "1.19"},
+		},
+		{
+			image: "centrify/webhook-server:0.1.0",
+			want:  imageRef{domain: "docker.io", registry: "registry-1.docker.io", repository: "centrify/webhook-server", tag: "0.1.0"},
+		},
+		{
+			image: "registry.example.com:5000/team/app:1.0",
+			want:  imageRef{domain: "registry.example.com:5000", registry: "registry.example.com:5000", repository: "team/app", tag: "1.0"},
+		},
+		{
+			image: "localhost/app",
+			want:  imageRef{domain: "localhost", registry: "localhost", repository: "app", tag: "latest"},
+		},
+		{
+			image: "localhost:5000/app@sha256:abc",
+			want:  imageRef{domain: "localhost:5000", registry: "localhost:5000", repository: "app", digest: "sha256:abc"},
+		},
+		{
+			image: "gcr.io/project/app:1.0@sha256:abc",
+			want:  imageRef{domain: "gcr.io", registry: "gcr.io", repository: "project/app", tag: "1.0", digest: "sha256:abc"},
+		},
+		{
+			image: "registry.example.com:5000/",
+			err:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.image, func(t *testing.T) {
+			ref, err := parseImageRef(tt.image)
+			if tt.err {
+				if err == nil {
+					t.Errorf("parseImageRef() = %+v, want error", ref)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseImageRef() error = %v", err)
+			}
+			if ref != tt.want {
+				t.Errorf("parseImageRef() = %+v, want %+v", ref, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseChallenge(t *testing.T) {
+	scheme, params := parseChallenge(`Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/nginx:pull"`)
+	want := map[string]string{"realm": "https://auth.docker.io/token", "service": "registry.docker.io", "scope": "repository:library/nginx:pull"}
+	if scheme != "Bearer" || !reflect.DeepEqual(params, want) {
+		t.Errorf("parseChallenge() = %s %v, want Bearer %v", scheme, params, want)
+	}
+}
+
+const (
+	testRepository = "team/app"
+	testUsername   = "puller"
+	testPassword   = "pull-password"
+	testToken      = "registry-token"
+)
+
+// fakeRegistry is a stand-in of registry HTTP API V2 serving a multi-platform image tagged "1.0" and
+// a single platform image tagged "single"
+type fakeRegistry struct {
+	auth         string // "basic" or "bearer" if registry requires authentication
+	noHeadDigest bool   // omit Docker-Content-Digest from HEAD responses like some registries do
+	delay        time.Duration
+
+	server    *httptest.Server
+	manifests map[string][]byte // by tag and digest
+	blobs     map[string][]byte
+
+	mu       sync.Mutex
+	requests []string
+}
+
+func digestOf(content []byte) string {
+	sum := sha256.Sum256(content)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func mustJSON(t *testing.T, v interface{}) []byte {
+	t.Helper()
+	content, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
+
+func newFakeRegistry(t *testing.T, auth string) *fakeRegistry {
+	r := &fakeRegistry{auth: auth, manifests: map[string][]byte{}, blobs: map[string][]byte{}}
+
+	manifestFor := func(entrypoint string, cmd string) []byte {
+		config := mustJSON(t, map[string]interface{}{
+			"architecture": "amd64",
+			"config":       map[string]interface{}{"Entrypoint": []string{entrypoint}, "Cmd": []string{cmd}},
+		})
+		r.blobs[digestOf(config)] = config
+		manifest := mustJSON(t, map[string]interface{}{
+			"schemaVersion": 2,
+			"mediaType":     mediaTypeDockerManifest,
+			"config":        map[string]interface{}{"mediaType": "application/vnd.docker.container.image.v1+json", "digest": digestOf(config)},
+		})
+		r.manifests[digestOf(manifest)] = manifest
+		return manifest
+	}
+	platform := func(manifest []byte, os string, arch string) map[string]interface{} {
+		return map[string]interface{}{
+			"mediaType": mediaTypeDockerManifest,
+			"digest":    digestOf(manifest),
+			"platform":  map[string]string{"os": os, "architecture": arch},
+		}
+	}
+
+	amd64 := manifestFor("/amd64-entrypoint", "amd64-cmd")
+	arm64 := manifestFor("/arm64-entrypoint", "arm64-cmd")
+	index := mustJSON(t, map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     mediaTypeDockerManifestList,
+		"manifests":     []interface{}{platform(arm64, "linux", "arm64"), platform(amd64, "linux", "amd64")},
+	})
+	r.manifests[digestOf(index)] = index
+	r.manifests["1.0"] = index
+	r.manifests["single"] = manifestFor("/single-entrypoint", "single-cmd")
+
+	r.server = httptest.NewServer(http.HandlerFunc(r.serveHTTP))
+	return r
+}
+
+// ref returns reference of image with tag in fake registry
+func (r *fakeRegistry) ref(t *testing.T, tag string) imageRef {
+	ref, err := parseImageRef(r.host(t) + "/" + testRepository + ":" + tag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ref
+}
+
+func (r *fakeRegistry) host(t *testing.T) string {
+	u, err := url.Parse(r.server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u.Host
+}
+
+func (r *fakeRegistry) client(t *testing.T, platform string) *registryClient {
+	return newRegistryClient(5*time.Second, []string{r.host(t)}, platform)
+}
+
+func (r *fakeRegistry) count(prefix string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	for _, req := range r.requests {
+		if strings.HasPrefix(req, prefix) {
+			n++
+		}
+	}
+	return n
+}
+
+func (r *fakeRegistry) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	r.requests = append(r.requests, req.Method+" "+req.URL.Path)
+	r.mu.Unlock()
+	if r.delay > 0 {
+		time.Sleep(r.delay)
+	}
+
+	if req.URL.Path == "/token" {
+		user, password, ok := req.BasicAuth()
+		if !ok || user != testUsername || password != testPassword ||
+			req.URL.Query().Get("scope") != "repository:"+testRepository+":pull" || req.URL.Query().Get("service") != "fake-registry" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"access_token": testToken})
+		return
+	}
+
+	switch r.auth {
+	case "basic":
+		if user, password, ok := req.BasicAuth(); !ok || user != testUsername || password != testPassword {
+			w.Header().Set("WWW-Authenticate", `Basic realm="fake-registry"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	case "bearer":
+		if req.Header.Get("Authorization") != "Bearer "+testToken {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+r.server.URL+`/token",service="fake-registry"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	}
+
+	prefix := "/v2/" + testRepository + "/"
+	if !strings.HasPrefix(req.URL.Path, prefix) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	split := strings.SplitN(strings.TrimPrefix(req.URL.Path, prefix), "/", 2)
+	if len(split) != 2 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	var content []byte
+	var ok bool
+	switch split[0] {
+	case "manifests":
+		if content, ok = r.manifests[split[1]]; ok {
+			var m struct {
+				MediaType string `json:"mediaType"`
+			}
+			json.Unmarshal(content, &m)
+			w.Header().Set("Content-Type", m.MediaType)
+		}
+	case "blobs":
+		content, ok = r.blobs[split[1]]
+	}
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if req.Method != "HEAD" || !r.noHeadDigest {
+		w.Header().Set("Docker-Content-Digest", digestOf(content))
+	}
+	if req.Method != "HEAD" {
+		w.Write(content)
+	}
+}
+
+func TestRegistryLookup(t *testing.T) {
+	creds := &registryCredentials{username: testUsername, password: testPassword}
+	tests := []struct {
+		name         string
+		auth         string
+		creds        *registryCredentials
+		noHeadDigest bool
+		tag          string
+		platform     string
+		want         imageConfig
+		err          string
+	}{
+		{
+			name:     "manifest list selects platform",
+			tag:      "1.0",
+			platform: "linux/amd64",
+			want:     imageConfig{Entrypoint: []string{"/amd64-entrypoint"}, Cmd: []string{"amd64-cmd"}},
+		},
+		{
+			name:     "manifest list selects other platform",
+			tag:      "1.0",
+			platform: "linux/arm64",
+			want:     imageConfig{Entrypoint: []string{"/arm64-entrypoint"}, Cmd: []string{"arm64-cmd"}},
+		},
+		{
+			name:     "platform missing from manifest list",
+			tag:      "1.0",
+			platform: "windows/amd64",
+			err:      "has no manifest for platform windows/amd64",
+		},
+		{
+			name:     "single platform image",
+			tag:      "single",
+			platform: "linux/arm64",
+			want:     imageConfig{Entrypoint: []string{"/single-entrypoint"}, Cmd: []string{"single-cmd"}},
+		},
+		{
+			name:         "digest missing from HEAD response",
+			noHeadDigest: true,
+			tag:          "single",
+			platform:     "linux/amd64",
+			want:         imageConfig{Entrypoint: []string{"/single-entrypoint"}, Cmd: []string{"single-cmd"}},
+		},
+		{
+			name:     "unknown tag",
+			tag:      "2.0",
+			platform: "linux/amd64",
+			err:      "404 Not Found",
+		},
+		{
+			name:     "basic challenge",
+			auth:     "basic",
+			creds:    creds,
+			tag:      "1.0",
+			platform: "linux/amd64",
+			want:     imageConfig{Entrypoint: []string{"/amd64-entrypoint"}, Cmd: []string{"amd64-cmd"}},
+		},
+		{
+			name:     "basic challenge without pull secret",
+			auth:     "basic",
+			tag:      "1.0",
+			platform: "linux/amd64",
+			err:      "requires credentials, add an image pull secret",
+		},
+		{
+			name:     "basic challenge with wrong password",
+			auth:     "basic",
+			creds:    &registryCredentials{username: testUsername, password: "wrong"},
+			tag:      "1.0",
+			platform: "linux/amd64",
+			err:      "401 Unauthorized",
+		},
+		{
+			name:     "bearer challenge",
+			auth:     "bearer",
+			creds:    creds,
+			tag:      "1.0",
+			platform: "linux/amd64",
+			want:     imageConfig{Entrypoint: []string{"/amd64-entrypoint"}, Cmd: []string{"amd64-cmd"}},
+		},
+		{
+			name:     "bearer challenge refused by token endpoint",
+			auth:     "bearer",
+			tag:      "1.0",
+			platform: "linux/amd64",
+			err:      "token request to",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newFakeRegistry(t, tt.auth)
+			defer r.server.Close()
+			r.noHeadDigest = tt.noHeadDigest
+
+			config, err := r.client(t, tt.platform).lookup(context.Background(), r.ref(t, tt.tag), tt.creds)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("lookup() = %v, %v, want error %q", config, err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("lookup() error = %v", err)
+			}
+			if !reflect.DeepEqual(config, tt.want) {
+				t.Errorf("lookup() = %+v, want %+v", config, tt.want)
+			}
+		})
+	}
+}
+
+func TestRegistryLookupCache(t *testing.T) {
+	r := newFakeRegistry(t, "")
+	defer r.server.Close()
+	c := r.client(t, "linux/amd64")
+
+	for i := 0; i < 2; i++ {
+		if _, err := c.lookup(context.Background(), r.ref(t, "1.0"), nil); err != nil {
+			t.Fatalf("lookup() error = %v", err)
+		}
+	}
+	// Tag is resolved on every lookup since it may move, manifests and configuration are only read once
+	if n := r.count("HEAD /v2/" + testRepository + "/manifests/1.0"); n != 2 {
+		t.Errorf("tag requested %d times, want 2", n)
+	}
+	if n := r.count("GET /v2/" + testRepository + "/manifests/sha256:"); n != 2 {
+		t.Errorf("manifests read %d times, want 2 for manifest list and platform manifest", n)
+	}
+	if n := r.count("GET /v2/" + testRepository + "/blobs/"); n != 1 {
+		t.Errorf("configuration read %d times, want 1", n)
+	}
+
+	// Lookup by cached digest needs no request at all
+	ref := r.ref(t, "1.0")
+	ref.tag, ref.digest = "", digestOf(r.manifests["1.0"])
+	requests := r.count("")
+	if _, err := c.lookup(context.Background(), ref, nil); err != nil {
+		t.Fatalf("lookup() by digest error = %v", err)
+	}
+	if n := r.count(""); n != requests {
+		t.Errorf("lookup() by cached digest sent %d requests", n-requests)
+	}
+}
+
+// TestRegistryLookupCacheCredentials checks that configuration of a private image read with one pull secret isn't
+// served to lookups without it
+func TestRegistryLookupCacheCredentials(t *testing.T) {
+	r := newFakeRegistry(t, "basic")
+	defer r.server.Close()
+	c := r.client(t, "linux/amd64")
+	ref := r.ref(t, "1.0")
+	ref.tag, ref.digest = "", digestOf(r.manifests["1.0"])
+	creds := &registryCredentials{username: testUsername, password: testPassword}
+
+	if _, err := c.lookup(context.Background(), ref, creds); err != nil {
+		t.Fatalf("lookup() error = %v", err)
+	}
+	requests := r.count("")
+	if _, err := c.lookup(context.Background(), ref, creds); err != nil {
+		t.Fatalf("lookup() with the same credentials error = %v", err)
+	}
+	if n := r.count(""); n != requests {
+		t.Errorf("lookup() with the same credentials sent %d requests", n-requests)
+	}
+
+	if _, err := c.lookup(context.Background(), ref, nil); err == nil {
+		t.Error("lookup() without credentials of cached private image succeeded")
+	}
+	other := &registryCredentials{username: testUsername, password: "wrong"}
+	if _, err := c.lookup(context.Background(), ref, other); err == nil {
+		t.Error("lookup() with other credentials of cached private image succeeded")
+	}
+}
+
+func TestRegistryLookupDeadline(t *testing.T) {
+	r := newFakeRegistry(t, "")
+	defer r.server.Close()
+	r.delay = 200 * time.Millisecond
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := r.client(t, "linux/amd64").lookup(ctx, r.ref(t, "1.0"), nil)
+	if err == nil || !strings.Contains(err.Error(), "context deadline exceeded") {
+		t.Errorf("lookup() error = %v, want context deadline exceeded", err)
+	}
+	// Each request is shorter than client timeout, so only the shared deadline ends lookup
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("lookup() took %v despite deadline", elapsed)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+)
+
+// certReloader serves the TLS certificate of webhook server, replacing it when certificate files are rotated
+// such as by cert-manager
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+// newCertReloader loads certificate and private key. It fails unless they form a valid key pair that has not expired.
+func newCertReloader(certFile string, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// reload replaces served certificate with the one in certificate files. Served certificate is kept if they are invalid.
+func (c *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("Failed to load key pair: %v", err)
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return fmt.Errorf("Failed to parse certificate %s: %v", c.certFile, err)
+	}
+	if time.Now().After(cert.Leaf.NotAfter) {
+		return fmt.Errorf("Certificate %s expired at %v", c.certFile, cert.Leaf.NotAfter)
+	}
+
+	c.mu.Lock()
+	c.cert = &cert
+	c.mu.Unlock()
+	klog.Infof("Loaded certificate %s for %v, valid until %v", c.certFile, cert.Leaf.DNSNames, cert.Leaf.NotAfter)
+	return nil
+}
+
+// GetCertificate is used as tls.Config.GetCertificate so that every TLS handshake uses the latest certificate
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// fileWatcher calls reload when modification time or size of any of files changes. Files are polled since mounted
+// Secrets and ConfigMaps are updated by swapping symlinks, which is not reported for the files themselves.
+type fileWatcher struct {
+	files  []string
+	reload func() error
+	state  string
+}
+
+func newFileWatcher(reload func() error, files ...string) *fileWatcher {
+	w := &fileWatcher{files: files, reload: reload}
+	w.state = w.stat()
+	return w
+}
+
+// stat describes the current version of files
+func (w *fileWatcher) stat() string {
+	var state []string
+	for _, f := range w.files {
+		info, err := os.Stat(f)
+		if err != nil {
+			state = append(state, f+": "+err.Error())
+			continue
+		}
+		state = append(state, fmt.Sprintf("%s: %v %d", f, info.ModTime().UnixNano(), info.Size()))
+	}
+	return strings.Join(state, "\n")
+}
+
+// check reloads files if they changed since last successful reload. Failed reloads are retried on next check
+// since files of a key pair may not be updated at once.
+func (w *fileWatcher) check() {
+	state := w.stat()
+	if state == w.state {
+		return
+	}
+	if err := w.reload(); err != nil {
+		klog.Errorf("Failed to reload %s: %v", strings.Join(w.files, ", "), err)
+		return
+	}
+	w.state = state
+}
+
+// watchFiles checks watchers every interval until stop is closed
+func watchFiles(interval time.Duration, stop <-chan struct{}, watchers ...*fileWatcher) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			for _, w := range watchers {
+				w.check()
+			}
+		}
+	}
+}
@@ -10,13 +10,19 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
+	"github.com/marcozj/k8s-secret-injection/internal/redact"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	v1 "k8s.io/api/admission/v1"
 	"k8s.io/api/admission/v1beta1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/klog"
 )
 
@@ -25,27 +31,39 @@ type ServerParameters struct {
 	port       int    // webhook server port
 	certFile   string // path to the x509 certificate for https
 	keyFile    string // path to the x509 private key matching `CertFile`
-	envCfgFile string // path to setenv configuration file
+	configFile string // path to webhook configuration file
+	// how often certificate and config files are checked for changes
+	reloadInterval time.Duration
+	// Image configuration lookup for containers without command
+	imageFixture       string        // path to file that image configurations are served from instead of registries
+	insecureRegistries string        // comma separated registries accessed over plain HTTP
+	readPullSecrets    bool          // read image pull secrets of pods from Kubernetes API to access private registries
+	registryPlatform   string        // platform selected from multi-platform images
+	registryTimeout    time.Duration // time limit of a single request to registry or Kubernetes API
 }
 
 // WebhookServer webhook server construct
 type WebhookServer struct {
-	//sidecarConfig *Config
-	setenvConfig *setEnvConfig
-	server       *http.Server
-}
-
-type setEnvConfig struct {
-	EnvVars []corev1.EnvVar `yaml:"env"`
+	server *http.Server
 }
 
 var scheme = runtime.NewScheme()
 var codecs = serializer.NewCodecFactory(scheme)
 
+func init() {
+	addToScheme(scheme)
+}
+
+func addToScheme(scheme *runtime.Scheme) {
+	utilruntime.Must(corev1.AddToScheme(scheme))
+	utilruntime.Must(v1beta1.AddToScheme(scheme))
+	utilruntime.Must(v1.AddToScheme(scheme))
+}
+
 // admissionResponseError is a helper function to create an AdmissionResponse
 // with an embedded error
-func admissionResponseError(err error) *v1beta1.AdmissionResponse {
-	return &v1beta1.AdmissionResponse{
+func admissionResponseError(err error) *v1.AdmissionResponse {
+	return &v1.AdmissionResponse{
 		Result: &metav1.Status{
 			Message: err.Error(),
 		},
@@ -53,10 +71,36 @@ func admissionResponseError(err error) *v1beta1.AdmissionResponse {
 }
 
 // admitFunc is the type we use for all of our validators and mutators
-type admitFunc func(v1beta1.AdmissionReview) *v1beta1.AdmissionResponse
+type admitFunc func(v1.AdmissionReview) *v1.AdmissionResponse
+
+// admitV1beta1Func handles the legacy v1beta1 AdmissionReview
+type admitV1beta1Func func(v1beta1.AdmissionReview) *v1beta1.AdmissionResponse
+
+// admitHandler holds an admit function for each supported AdmissionReview version
+type admitHandler struct {
+	v1beta1 admitV1beta1Func
+	v1      admitFunc
+}
+
+// newDelegateToV1AdmitHandler returns an admitHandler that answers both versions
+// with the same v1 admit function
+func newDelegateToV1AdmitHandler(f admitFunc) admitHandler {
+	return admitHandler{
+		v1beta1: delegateV1beta1AdmitToV1(f),
+		v1:      f,
+	}
+}
+
+func delegateV1beta1AdmitToV1(f admitFunc) admitV1beta1Func {
+	return func(review v1beta1.AdmissionReview) *v1beta1.AdmissionResponse {
+		in := v1.AdmissionReview{Request: convertAdmissionRequestToV1(review.Request)}
+		out := f(in)
+		return convertAdmissionResponseToV1beta1(out)
+	}
+}
 
 // serve handles the http portion of a request prior to handing to an admit function
-func serve(w http.ResponseWriter, r *http.Request, admit admitFunc) {
+func serve(w http.ResponseWriter, r *http.Request, admit admitHandler) {
 	var body []byte
 	if r.Body != nil {
 		if data, err := ioutil.ReadAll(r.Body); err == nil {
@@ -77,43 +121,99 @@ func serve(w http.ResponseWriter, r *http.Request, admit admitFunc) {
 		return
 	}
 
-	klog.V(2).Info(fmt.Sprintf("handling request: %s", body))
-
-	// The AdmissionReview that was sent to the webhook
-	adminReviewRequest := v1beta1.AdmissionReview{}
+	klog.V(2).Info(fmt.Sprintf("handling request: %s", redact.JSON(body)))
 
-	// The AdmissionReview that will be returned
-	adminReviewRespond := v1beta1.AdmissionReview{}
-
-	deserializer := codecs.UniversalDeserializer()
-	if _, _, err := deserializer.Decode(body, nil, &adminReviewRequest); err != nil {
+	respObj, err := review(body, admit)
+	if err != nil {
 		klog.Errorf("Can't decode body: %v", err)
-		adminReviewRespond.Response = admissionResponseError(err)
-	} else {
-		// pass to admitFunc
-		adminReviewRespond.Response = admit(adminReviewRequest)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	// Return the same UID
-	//adminReviewRespond.Response.UID = adminReviewRequest.Request.UID
-
-	//klog.V(2).Info(fmt.Sprintf("sending response: %v", adminReviewRespond.Response))
-	//klog.Infof("sending response: %v", adminReviewRespond)
-
-	respBytes, err := json.Marshal(adminReviewRespond)
+	respBytes, err := json.Marshal(respObj)
 	if err != nil {
 		klog.Errorf("Can't encode response: %v", err)
 		http.Error(w, fmt.Sprintf("could not encode response: %v", err), http.StatusInternalServerError)
+		return
 	}
 	klog.Infof("Ready to write reponse ...")
+	w.Header().Set("Content-Type", "application/json")
 	if _, err := w.Write(respBytes); err != nil {
 		klog.Errorf("Can't write response: %v", err)
 		http.Error(w, fmt.Sprintf("could not write response: %v", err), http.StatusInternalServerError)
 	}
 }
 
+// review decodes the AdmissionReview that was sent to the webhook, passes it to the
+// admit function matching its apiVersion and returns an AdmissionReview of the same
+// version with the request UID echoed back
+func review(body []byte, admit admitHandler) (runtime.Object, error) {
+	deserializer := codecs.UniversalDeserializer()
+	obj, gvk, err := deserializer.Decode(body, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Request could not be decoded: %v", err)
+	}
+
+	switch *gvk {
+	case v1beta1.SchemeGroupVersion.WithKind("AdmissionReview"):
+		requestedAdmissionReview, ok := obj.(*v1beta1.AdmissionReview)
+		if !ok {
+			return nil, fmt.Errorf("Expected v1beta1.AdmissionReview but got: %T", obj)
+		}
+		if requestedAdmissionReview.Request == nil {
+			return nil, fmt.Errorf("AdmissionReview contains no request")
+		}
+		responseAdmissionReview := &v1beta1.AdmissionReview{}
+		responseAdmissionReview.SetGroupVersionKind(*gvk)
+		responseAdmissionReview.Response = admit.v1beta1(*requestedAdmissionReview)
+		responseAdmissionReview.Response.UID = requestedAdmissionReview.Request.UID
+		return responseAdmissionReview, nil
+	case v1.SchemeGroupVersion.WithKind("AdmissionReview"):
+		requestedAdmissionReview, ok := obj.(*v1.AdmissionReview)
+		if !ok {
+			return nil, fmt.Errorf("Expected v1.AdmissionReview but got: %T", obj)
+		}
+		if requestedAdmissionReview.Request == nil {
+			return nil, fmt.Errorf("AdmissionReview contains no request")
+		}
+		responseAdmissionReview := &v1.AdmissionReview{}
+		responseAdmissionReview.SetGroupVersionKind(*gvk)
+		responseAdmissionReview.Response = admit.v1(*requestedAdmissionReview)
+		responseAdmissionReview.Response.UID = requestedAdmissionReview.Request.UID
+		return responseAdmissionReview, nil
+	default:
+		return nil, fmt.Errorf("Unsupported group version kind: %v", gvk)
+	}
+}
+
 func serveMutatePods(w http.ResponseWriter, r *http.Request) {
-	serve(w, r, mutatePods)
+	serve(w, r, newDelegateToV1AdmitHandler(mutatePods))
+}
+
+func serveValidatePods(w http.ResponseWriter, r *http.Request) {
+	serve(w, r, newDelegateToV1AdmitHandler(validatePods))
+}
+
+// serveHealthz tells that webhook server is alive
+func serveHealthz(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+// readyzHandler returns handler telling whether webhook server can answer admission requests,
+// that is it has a certificate that has not expired and a valid config
+func readyzHandler(certs *certReloader) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cert, _ := certs.GetCertificate(nil)
+		if cert == nil || time.Now().After(cert.Leaf.NotAfter) {
+			http.Error(w, "certificate is not loaded or has expired", http.StatusServiceUnavailable)
+			return
+		}
+		if err := currentWebhookConfig().validate(); err != nil {
+			http.Error(w, fmt.Sprintf("invalid config: %v", err), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	}
 }
 
 func main() {
@@ -122,27 +222,61 @@ func main() {
 	flag.IntVar(&parameters.port, "port", 8443, "Webhook server port.")
 	flag.StringVar(&parameters.certFile, "tlsCertFile", "/etc/certs/tls.crt", "File containing the x509 Certificate for HTTPS.")
 	flag.StringVar(&parameters.keyFile, "tlsKeyFile", "/etc/certs/tls.key", "File containing the x509 private key to --tlsCertFile.")
-	//flag.StringVar(&parameters.envCfgFile, "envCfgFile", "/etc/webhook/config/setenvconfig.yaml", "File containing the environment variables we want to inject.")
+	flag.StringVar(&parameters.imageFixture, "imageFixture", "", "YAML file that image entrypoints and cmds are read from instead of registries.")
+	flag.StringVar(&parameters.insecureRegistries, "insecureRegistries", "", "Comma separated registries, such as a local registry, that are accessed over plain HTTP.")
+	flag.BoolVar(&parameters.readPullSecrets, "readPullSecrets", false, "Read image pull secrets of pods to look up images in private registries. Requires permission to get secrets in their namespaces, see deployment/rbac-pull-secrets.yaml.")
+	flag.StringVar(&parameters.registryPlatform, "registryPlatform", defaultPlatform, "Platform selected from multi-platform images.")
+	flag.DurationVar(&parameters.registryTimeout, "registryTimeout", 10*time.Second, "Time limit of a single request to registry or Kubernetes API.")
+	flag.DurationVar(&imageLookupTimeout, "imageLookupTimeout", defaultImageLookupTimeout, "Time limit of looking up commands of all containers of a pod in registries. Must be shorter than timeoutSeconds of MutatingWebhookConfiguration.")
+	flag.StringVar(&parameters.configFile, "configFile", "", "YAML file containing defaults such as tenant URL, auth type and images, that annotations override.")
+	flag.DurationVar(&parameters.reloadInterval, "reloadInterval", 10*time.Second, "How often certificate and config files are checked for changes. 0 disables reloading.")
 	flag.Parse()
 
-	certs, err := tls.LoadX509KeyPair(parameters.certFile, parameters.keyFile)
+	cfg, err := loadWebhookConfig(parameters.configFile)
 	if err != nil {
-		klog.Errorf("Failed to load key pair: %v", err)
+		klog.Fatalf("%v", err)
+	}
+	setWebhookConfig(cfg)
+
+	certs, err := newCertReloader(parameters.certFile, parameters.keyFile)
+	if err != nil {
+		klog.Fatalf("%v", err)
+	}
+
+	if parameters.imageFixture != "" {
+		fixture, err := newFixtureImageConfigs(parameters.imageFixture)
+		if err != nil {
+			klog.Fatalf("%v", err)
+		}
+		imageConfigs = fixture
+	} else {
+		source := &registryImageConfigs{
+			registry: newRegistryClient(parameters.registryTimeout, strings.Split(parameters.insecureRegistries, ","), parameters.registryPlatform),
+		}
+		if parameters.readPullSecrets {
+			if source.secrets, err = newKubeSecrets(parameters.registryTimeout); err != nil {
+				klog.Warningf("Image pull secrets can't be read: %v", err)
+			}
+		}
+		imageConfigs = source
 	}
 
 	klog.Infoln("Credential is being injected by Mutating Webhook ...")
 	//fmt.Println("Credential is being injected by Mutating Webhook ...")
 
 	server := &WebhookServer{
-		//setenvConfig: setEnvConfig,
 		server: &http.Server{
 			Addr:      fmt.Sprintf(":%v", parameters.port),
-			TLSConfig: &tls.Config{Certificates: []tls.Certificate{certs}},
+			TLSConfig: &tls.Config{GetCertificate: certs.GetCertificate},
 		},
 	}
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/mutate", serveMutatePods)
+	mux.HandleFunc("/validate", serveValidatePods)
+	mux.HandleFunc("/healthz", serveHealthz)
+	mux.HandleFunc("/readyz", readyzHandler(certs))
+	mux.Handle("/metrics", promhttp.Handler())
 	server.server.Handler = mux
 
 	// start webhook server in new rountine
@@ -152,11 +286,29 @@ func main() {
 		}
 	}()
 
+	stopWatching := make(chan struct{})
+	if parameters.reloadInterval > 0 {
+		watchers := []*fileWatcher{newFileWatcher(certs.reload, parameters.certFile, parameters.keyFile)}
+		if parameters.configFile != "" {
+			watchers = append(watchers, newFileWatcher(func() error {
+				cfg, err := loadWebhookConfig(parameters.configFile)
+				if err != nil {
+					return err
+				}
+				setWebhookConfig(cfg)
+				klog.Infof("Reloaded config file %s", parameters.configFile)
+				return nil
+			}, parameters.configFile))
+		}
+		go watchFiles(parameters.reloadInterval, stopWatching, watchers...)
+	}
+
 	// listening OS shutdown singal
 	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
 	<-signalChan
 
 	klog.Infof("Got OS shutdown signal, shutting down webhook server gracefully...")
+	close(stopWatching)
 	server.server.Shutdown(context.Background())
 }
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/admission/v1"
+	"k8s.io/api/admission/v1beta1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func readTestdata(t *testing.T, name string) []byte {
+	t.Helper()
+	body, err := ioutil.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func TestReview(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       []byte
+		apiVersion string
+		uid        types.UID
+		patched    bool
+		err        string
+	}{
+		{
+			name:       "v1",
+			body:       readTestdata(t, "admissionreview-v1.json"),
+			apiVersion: "admission.k8s.io/v1",
+			uid:        "4b9e1c2a-5f3d-4c8e-a1b7-9d2e6f0a3c51",
+			patched:    true,
+		},
+		{
+			name:       "v1beta1",
+			body:       readTestdata(t, "admissionreview-v1beta1.json"),
+			apiVersion: "admission.k8s.io/v1beta1",
+			uid:        "8e2f7a1c-3b6d-4f9e-b2a8-1c5d7e9f0b42",
+			patched:    true,
+		},
+		{
+			// v1beta1 response has no patchType at all, rather than a null one, unless pod is patched
+			name: "v1beta1 not mutated",
+			body: []byte(`{"apiVersion":"admission.k8s.io/v1beta1","kind":"AdmissionReview","request":{"uid":"1f0c9d8e-4a5b-11e9-8f0e-0242ac110002",` +
+				`"kind":{"group":"","version":"v1","kind":"Pod"},"resource":{"group":"","version":"v1","resource":"pods"},"namespace":"default","operation":"CREATE",` +
+				`"object":{"kind":"Pod","apiVersion":"v1","metadata":{"generateName":"busybox-","creationTimestamp":null},"spec":{"containers":[{"name":"busybox","image":"busybox"}]},"status":{}}}}`),
+			apiVersion: "admission.k8s.io/v1beta1",
+			uid:        "1f0c9d8e-4a5b-11e9-8f0e-0242ac110002",
+		},
+		{
+			name: "v1 without request",
+			body: []byte(`{"apiVersion":"admission.k8s.io/v1","kind":"AdmissionReview"}`),
+			err:  "contains no request",
+		},
+		{
+			name: "v1beta1 without request",
+			body: []byte(`{"apiVersion":"admission.k8s.io/v1beta1","kind":"AdmissionReview"}`),
+			err:  "contains no request",
+		},
+		{
+			name: "unknown group version kind",
+			body: []byte(`{"apiVersion":"v1","kind":"Pod","metadata":{"name":"p"}}`),
+			err:  "Unsupported group version kind",
+		},
+		{
+			name: "unregistered kind",
+			body: []byte(`{"apiVersion":"admission.k8s.io/v2","kind":"AdmissionReview"}`),
+			err:  "could not be decoded",
+		},
+		{
+			name: "not json",
+			body: []byte(`not an admission review`),
+			err:  "could not be decoded",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			obj, err := review(tt.body, newDelegateToV1AdmitHandler(mutatePods))
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("review() error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("review() error = %v", err)
+			}
+
+			out, err := json.Marshal(obj)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var typeMeta struct {
+				APIVersion string `json:"apiVersion"`
+				Kind       string `json:"kind"`
+			}
+			if err := json.Unmarshal(out, &typeMeta); err != nil {
+				t.Fatal(err)
+			}
+			if !tt.patched && strings.Contains(string(out), "patchType") {
+				t.Errorf("response of unmutated pod has patch type: %s", out)
+			}
+			if typeMeta.APIVersion != tt.apiVersion || typeMeta.Kind != "AdmissionReview" {
+				t.Errorf("response is %s %s, want %s AdmissionReview", typeMeta.APIVersion, typeMeta.Kind, tt.apiVersion)
+			}
+
+			var uid types.UID
+			var allowed bool
+			var patch []byte
+			var patchType string
+			switch r := obj.(type) {
+			case *v1.AdmissionReview:
+				uid, allowed, patch = r.Response.UID, r.Response.Allowed, r.Response.Patch
+				if r.Response.PatchType != nil {
+					patchType = string(*r.Response.PatchType)
+				}
+			case *v1beta1.AdmissionReview:
+				uid, allowed, patch = r.Response.UID, r.Response.Allowed, r.Response.Patch
+				if r.Response.PatchType != nil {
+					patchType = string(*r.Response.PatchType)
+				}
+			default:
+				t.Fatalf("response is %T", obj)
+			}
+			if uid != tt.uid {
+				t.Errorf("response UID = %q, want %q", uid, tt.uid)
+			}
+			if !allowed {
+				t.Error("pod is not allowed")
+			}
+			if !tt.patched {
+				if patch != nil || patchType != "" {
+					t.Errorf("unmutated pod has patch %s of type %q", patch, patchType)
+				}
+				return
+			}
+			if patchType != "JSONPatch" {
+				t.Errorf("patch type = %q, want JSONPatch", patchType)
+			}
+			checkPatch(t, patch)
+		})
+	}
+}
+
+// checkPatch checks that patch of captured pod adds init container and marks pod as injected
+func checkPatch(t *testing.T, patch []byte) {
+	t.Helper()
+	var ops []struct {
+		Op    string          `json:"op"`
+		Path  string          `json:"path"`
+		Value json.RawMessage `json:"value"`
+	}
+	if err := json.Unmarshal(patch, &ops); err != nil {
+		t.Fatalf("patch is not a JSON patch: %v", err)
+	}
+
+	var initContainer, secretVolume, status bool
+	for _, op := range ops {
+		if op.Op != "add" {
+			t.Errorf("unexpected %s operation on %s", op.Op, op.Path)
+		}
+		switch {
+		case op.Path == "/spec/initContainers":
+			initContainer = strings.Contains(string(op.Value), `"centrifyk8s-init"`) &&
+				strings.Contains(string(op.Value), `"vault://secret/wordpress/dbpassword"`)
+		case op.Path == "/spec/volumes/-" && strings.Contains(string(op.Value), `"`+secretVolumeName+`"`):
+			secretVolume = true
+		case op.Path == "/metadata/annotations":
+			status = strings.Contains(string(op.Value), `"`+annotationStatus+`":"injected"`)
+		}
+	}
+	if !initContainer {
+		t.Errorf("patch does not add init container with secret reference: %s", patch)
+	}
+	if !secretVolume {
+		t.Errorf("patch does not add secret volume: %s", patch)
+	}
+	if !status {
+		t.Errorf("patch does not set status annotation: %s", patch)
+	}
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/marcozj/k8s-secret-injection/internal/rules"
+	v1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/klog"
+)
+
+const vaultSchemePrefix = "vault://"
+
+// annotationErrors collects problems of annotations, each prefixed by annotation name
+type annotationErrors []string
+
+func (e *annotationErrors) add(key string, format string, args ...interface{}) {
+	*e = append(*e, key+": "+fmt.Sprintf(format, args...))
+}
+
+// validatePods denies pods whose annotations would make secret injection fail at runtime
+func validatePods(ar v1.AdmissionReview) *v1.AdmissionResponse {
+	klog.Info("validating pods")
+	req := ar.Request
+	var pod corev1.Pod
+	if err := json.Unmarshal(req.Object.Raw, &pod); err != nil {
+		klog.Errorf("Could not unmarshal raw object: %v", err)
+		return admissionResponseError(err)
+	}
+
+	resp := &v1.AdmissionResponse{
+		Allowed: true,
+		UID:     req.UID,
+	}
+	config := currentWebhookConfig()
+	for _, namespace := range config.IgnoredNamespaces {
+		if req.Namespace == namespace {
+			return resp
+		}
+	}
+	// Annotations of pods that are not mutated have no effect
+	if !isYes(pod.Annotations[annotationMutate]) {
+		return resp
+	}
+
+	errs := validateAnnotations(&pod, config)
+	if len(errs) == 0 {
+		return resp
+	}
+	klog.Infof("Denying pod %s/%s: %s", req.Namespace, pod.Name, strings.Join(errs, "; "))
+	resp.Allowed = false
+	resp.Result = &metav1.Status{
+		Status:  metav1.StatusFailure,
+		Reason:  metav1.StatusReasonInvalid,
+		Code:    http.StatusUnprocessableEntity,
+		Message: "invalid vault.centrify.com annotations: " + strings.Join(errs, "; "),
+	}
+	return resp
+}
+
+// isYes tells whether value of mutate annotation requests mutation
+func isYes(value string) bool {
+	switch strings.ToLower(value) {
+	case "y", "yes", "true", "on":
+		return true
+	}
+	return false
+}
+
+// validateAnnotations checks vault.centrify.com annotations of pod against the rules in README. Values that
+// are not annotated are taken from config. Annotations that config doesn't allow are ignored, as mutation does.
+func validateAnnotations(pod *corev1.Pod, config *webhookConfig) annotationErrors {
+	var errs annotationErrors
+	annotations := config.filterAnnotations(pod.Annotations)
+
+	// Unknown annotations are reported even if they are not allowed, since they are likely misspelled
+	var keys []string
+	for key := range pod.Annotations {
+		if strings.HasPrefix(key, annotationPrefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	containers := make(map[string]bool)
+	for _, c := range pod.Spec.Containers {
+		containers[c.Name] = true
+	}
+	secrets := make(map[string]bool)
+	files := make(map[string]string)
+	addFile := func(key string, name string) {
+		if other, ok := files[name]; ok {
+			errs.add(key, "file %s is also written by %s", name, other)
+		}
+		files[name] = key
+	}
+	for _, key := range keys {
+		if strings.HasPrefix(key, annotationSecretPrefix) && config.isAllowed(key) {
+			secrets[strings.TrimPrefix(key, annotationSecretPrefix)] = true
+		}
+	}
+
+	for _, key := range keys {
+		if !isKnownAnnotation(key) {
+			errs.add(key, "unknown annotation")
+			continue
+		}
+		value, ok := annotations[key]
+		if !ok {
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(key, annotationSecretPrefix):
+			name := strings.TrimPrefix(key, annotationSecretPrefix)
+			for _, msg := range validation.IsEnvVarName(name) {
+				errs.add(key, "invalid secret file name %q: %s", name, msg)
+			}
+			file, err := validateSecretRef(value)
+			if err != nil {
+				errs.add(key, "%v", err)
+				continue
+			}
+			if file == "" {
+				file = name
+			}
+			addFile(key, file)
+		case strings.HasPrefix(key, annotationTemplatePrefix):
+			name := strings.TrimPrefix(key, annotationTemplatePrefix)
+			if _, err := rules.ParseTemplate(name, value); err != nil {
+				errs.add(key, "invalid template: %v", err)
+				continue
+			}
+			addFile(key, name)
+		case strings.HasPrefix(key, annotationContainerSecrets):
+			container := strings.TrimPrefix(key, annotationContainerSecrets)
+			if !containers[container] {
+				errs.add(key, "pod has no container %s", container)
+			}
+			for _, s := range strings.Split(value, ",") {
+				if s = strings.TrimSpace(s); s != "" && !secrets[s] {
+					errs.add(key, "secret %s is not defined by a %s<name> annotation", s, annotationSecretPrefix)
+				}
+			}
+		}
+
+		switch key {
+		case annotationInitContainer, annotationSidecarContainer, annotationFilesOnly, annotationSupervise, annotationStrict:
+			if v := strings.ToLower(value); v != "yes" && v != "no" {
+				errs.add(key, "%q must be \"yes\" or \"no\"", value)
+			}
+		case annotationWorkers, annotationRetryAttempts:
+			if n, err := strconv.Atoi(value); err != nil || n < 1 {
+				errs.add(key, "%q must be a positive number", value)
+			}
+		case annotationRetryDeadline, annotationRequestTimeout, annotationReadyTimeout:
+			if d, err := time.ParseDuration(value); err != nil || d <= 0 {
+				errs.add(key, "%q must be a positive duration such as \"30s\" or \"5m\"", value)
+			}
+		case annotationRefreshInterval:
+			if d, err := time.ParseDuration(value); err != nil || d <= 0 {
+				errs.add(key, "%q must be a positive duration such as \"30s\" or \"5m\"", value)
+			} else if strings.ToLower(annotations[annotationSidecarContainer]) != "yes" {
+				errs.add(key, "requires %s annotation to be \"yes\"", annotationSidecarContainer)
+			}
+		case annotationFileMode:
+			if mode, err := strconv.ParseUint(value, 8, 32); err != nil || mode > 0777 {
+				errs.add(key, "%q must be an octal permission such as \"0640\"", value)
+			}
+		case annotationFileUID, annotationFileGID:
+			if id, err := strconv.Atoi(value); err != nil || id < 0 {
+				errs.add(key, "%q must be a numeric id", value)
+			}
+		case annotationEnvCollision:
+			if value != "override" && value != "keep-existing" && value != "fail" {
+				errs.add(key, "%q must be \"override\", \"keep-existing\" or \"fail\"", value)
+			}
+		case annotationOnSecretChange:
+			if value != "none" && value != "signal" && value != "restart" {
+				errs.add(key, "%q must be \"none\", \"signal\" or \"restart\"", value)
+			} else if value != "none" && strings.ToLower(annotations[annotationSupervise]) != "yes" {
+				errs.add(key, "requires %s annotation to be \"yes\"", annotationSupervise)
+			}
+		case annotationReloadSignal:
+			if _, err := rules.ParseSignal(value); err != nil {
+				errs.add(key, "%v", err)
+			}
+		case annotationSecretsPath, annotationAppLauncher, annotationPasswordFile:
+			if !path.IsAbs(value) {
+				errs.add(key, "%q must be an absolute path", value)
+			}
+		case annotationTokenFile:
+			// Token file is mounted from Kubernetes secret at its directory, which can't be the root
+			if !path.IsAbs(value) || path.Dir(path.Clean(value)) == "/" {
+				errs.add(key, "%q must be an absolute path of a file in a directory other than /", value)
+			}
+		case annotationTokenEndpoint:
+			if u, err := url.Parse(value); err != nil || u.Scheme != "https" || u.Host == "" {
+				errs.add(key, "%q must be an https URL", value)
+			}
+		case annotationContainers:
+			for _, c := range strings.Split(value, ",") {
+				if c = strings.TrimSpace(c); c != "" && !containers[c] {
+					errs.add(key, "pod has no container %s", c)
+				}
+			}
+		case annotationOutput:
+			outputs, err := rules.ParseOutputs(value)
+			if err != nil {
+				errs.add(key, "%v", err)
+			}
+			for _, o := range outputs {
+				addFile(key, o.File)
+			}
+		}
+	}
+
+	if len(secrets) == 0 {
+		errs.add(annotationSecretPrefix+"<name>", "at least one password or secret must be checked out")
+	}
+
+	tenantURL := annotationOrDefault(annotations, annotationTenanturl, config.TenantURL)
+	if tenantURL == "" {
+		errs.add(annotationTenanturl, "annotation is required")
+	} else if u, err := url.Parse(tenantURL); err != nil || u.Scheme != "https" || u.Host == "" {
+		errs.add(annotationTenanturl, "%q must be an https URL", tenantURL)
+	}
+	required := func(key string, authType string) {
+		if annotations[key] == "" {
+			errs.add(key, "annotation is required if %s annotation is %q", annotationAuthType, authType)
+		}
+	}
+	switch authType := strings.ToLower(annotationOrDefault(annotations, annotationAuthType, config.AuthType)); authType {
+	case "oauth":
+		required(annotationAppID, authType)
+		required(annotationScope, authType)
+		if annotations[annotationToken] == "" {
+			required(annotationOauthSecretName, authType)
+		}
+	case "unpw":
+		required(annotationUser, authType)
+		required(annotationOauthSecretName, authType)
+	case "k8s":
+		// Scope of access token that ServiceAccount token is exchanged for
+		required(annotationScope, authType)
+		if annotationOrDefault(annotations, annotationTokenEndpoint, config.TokenEndpoint) == "" {
+			required(annotationAppID, authType)
+		}
+	case "dmc":
+		if strings.ToLower(annotations[annotationSidecarContainer]) != "yes" {
+			errs.add(annotationSidecarContainer, "must be \"yes\" if %s annotation is %q", annotationAuthType, authType)
+		}
+		required(annotationEnrollmentCode, authType)
+		required(annotationScope, authType)
+	case "":
+		errs.add(annotationAuthType, "annotation is required")
+	default:
+		errs.add(annotationAuthType, "%q must be \"oauth\", \"unpw\", \"dmc\" or \"k8s\"", authType)
+	}
+
+	return errs
+}
+
+// annotationOrDefault returns value of annotation key, or defaultValue if it is not set
+func annotationOrDefault(annotations map[string]string, key string, defaultValue string) string {
+	if value := annotations[key]; value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+// validateSecretRef checks reference to password or secret such as "vault://database/MSSQL/dbadmin?mode=0400#password"
+// as secret injector parses it. It returns secret file name given by "file" option.
+func validateSecretRef(value string) (string, error) {
+	if !strings.HasPrefix(value, vaultSchemePrefix) {
+		return "", fmt.Errorf("%q must start with %s", value, vaultSchemePrefix)
+	}
+	ref := strings.TrimPrefix(value, vaultSchemePrefix)
+	var field, query string
+	if idx := strings.LastIndex(ref, "#"); idx >= 0 {
+		ref, field = ref[:idx], ref[idx+1:]
+	}
+	if idx := strings.Index(ref, "?"); idx >= 0 {
+		ref, query = ref[:idx], ref[idx+1:]
+	}
+
+	segments := strings.Split(ref, "/")
+	for _, s := range segments {
+		if s == "" {
+			return "", fmt.Errorf("%q has an empty path segment", value)
+		}
+	}
+	switch segments[0] {
+	case "secret":
+		if len(segments) < 2 {
+			return "", fmt.Errorf("%q must be vault://secret/<path name>/.../<secret name>", value)
+		}
+	case "system", "database", "domain":
+		if len(segments) != 3 {
+			return "", fmt.Errorf("%q must be vault://%s/<%s name>/<account name>", value, segments[0], segments[0])
+		}
+	default:
+		return "", fmt.Errorf("%q must refer to system, database, domain or secret", value)
+	}
+
+	if query == "" {
+		return "", nil
+	}
+	options, err := url.ParseQuery(query)
+	if err != nil {
+		return "", fmt.Errorf("%q has invalid options: %v", value, err)
+	}
+	var file string
+	for key := range options {
+		option := options.Get(key)
+		switch key {
+		case "mode":
+			if mode, err := strconv.ParseUint(option, 8, 32); err != nil || mode > 0777 {
+				return "", fmt.Errorf("%q has invalid file mode %s", value, option)
+			}
+		case "uid", "gid":
+			if id, err := strconv.Atoi(option); err != nil || id < 0 {
+				return "", fmt.Errorf("%q has invalid %s %s", value, key, option)
+			}
+		case "file":
+			if err := rules.CheckFileName(option); err != nil {
+				return "", fmt.Errorf("%q has %v", value, err)
+			}
+			file = option
+		case "field":
+			if field != "" && field != option {
+				return "", fmt.Errorf("%q has field %s that conflicts with #%s", value, option, field)
+			}
+		default:
+			return "", fmt.Errorf("%q has unknown option %s", value, key)
+		}
+	}
+	return file, nil
+}
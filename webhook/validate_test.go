@@ -0,0 +1,305 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// validOauthAnnotations are annotations of a pod that is admitted with empty config
+var validOauthAnnotations = map[string]string{
+	annotationMutate:                         "yes",
+	annotationTenanturl:                      "https://tenant.example.com",
+	annotationAuthType:                       "oauth",
+	annotationAppID:                          "vaultapp",
+	annotationScope:                          "all",
+	annotationOauthSecretName:                "vault-token",
+	annotationSecretPrefix + "DB_PASSWORD":   "vault://secret/app/db#password",
+	annotationSecretPrefix + "SYS_PASSWORD":  "vault://system/MySQL/dbadmin",
+	annotationTemplatePrefix + "config.yaml": `password: {{ secret "DB_PASSWORD" | json }}`,
+}
+
+// testPod returns pod with container "app" annotated with validOauthAnnotations changed by changes.
+// Annotations whose changed value is empty are removed.
+func testPod(changes map[string]string) *corev1.Pod {
+	annotations := make(map[string]string)
+	for key, value := range validOauthAnnotations {
+		annotations[key] = value
+	}
+	for key, value := range changes {
+		if value == "" {
+			delete(annotations, key)
+		} else {
+			annotations[key] = value
+		}
+	}
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Annotations: annotations},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app"}}},
+	}
+}
+
+func TestValidateAnnotations(t *testing.T) {
+	tests := []struct {
+		name    string
+		changes map[string]string
+		config  webhookConfig
+		errs    []string // substrings of expected errors in their order, none if pod is valid
+	}{
+		{
+			name: "valid oauth",
+		},
+		{
+			name:    "oauth without scope",
+			changes: map[string]string{annotationScope: ""},
+			errs:    []string{annotationScope + `: annotation is required if ` + annotationAuthType + ` annotation is "oauth"`},
+		},
+		{
+			name:    "oauth with token instead of secret",
+			changes: map[string]string{annotationOauthSecretName: "", annotationToken: "abc"},
+		},
+		{
+			name:    "oauth without token",
+			changes: map[string]string{annotationOauthSecretName: ""},
+			errs:    []string{annotationOauthSecretName + ": annotation is required"},
+		},
+		{
+			name: "unpw without scope",
+			changes: map[string]string{
+				annotationAuthType: "unpw",
+				annotationScope:    "",
+				annotationAppID:    "",
+				annotationUser:     "vaultuser@example.com",
+			},
+		},
+		{
+			name:    "unpw without user",
+			changes: map[string]string{annotationAuthType: "unpw"},
+			errs:    []string{annotationUser + `: annotation is required if ` + annotationAuthType + ` annotation is "unpw"`},
+		},
+		{
+			name:    "k8s without scope",
+			changes: map[string]string{annotationAuthType: "k8s", annotationScope: "", annotationOauthSecretName: ""},
+			errs:    []string{annotationScope + `: annotation is required if ` + annotationAuthType + ` annotation is "k8s"`},
+		},
+		{
+			name:    "k8s with token endpoint from config",
+			changes: map[string]string{annotationAuthType: "k8s", annotationAppID: ""},
+			config:  webhookConfig{TokenEndpoint: "https://tenant.example.com/oauth2/token/vaultapp"},
+		},
+		{
+			name:    "dmc without sidecar",
+			changes: map[string]string{annotationAuthType: "dmc", annotationEnrollmentCode: "code"},
+			errs:    []string{annotationSidecarContainer + `: must be "yes" if ` + annotationAuthType + ` annotation is "dmc"`},
+		},
+		{
+			name: "dmc without scope",
+			changes: map[string]string{
+				annotationAuthType:         "dmc",
+				annotationEnrollmentCode:   "code",
+				annotationSidecarContainer: "yes",
+				annotationScope:            "",
+			},
+			errs: []string{annotationScope + `: annotation is required if ` + annotationAuthType + ` annotation is "dmc"`},
+		},
+		{
+			name:    "auth type from config",
+			changes: map[string]string{annotationAuthType: ""},
+			config:  webhookConfig{AuthType: "oauth"},
+		},
+		{
+			name:    "auth type in upper case",
+			changes: map[string]string{annotationAuthType: "K8S", annotationScope: ""},
+			errs:    []string{annotationScope + `: annotation is required if ` + annotationAuthType + ` annotation is "k8s"`},
+		},
+		{
+			name:    "unknown auth type",
+			changes: map[string]string{annotationAuthType: "saml"},
+			errs:    []string{annotationAuthType + `: "saml" must be "oauth", "unpw", "dmc" or "k8s"`},
+		},
+		{
+			name:    "missing tenant URL",
+			changes: map[string]string{annotationTenanturl: ""},
+			errs:    []string{annotationTenanturl + ": annotation is required"},
+		},
+		{
+			name:    "tenant URL from config",
+			changes: map[string]string{annotationTenanturl: ""},
+			config:  webhookConfig{TenantURL: "https://tenant.example.com"},
+		},
+		{
+			name:    "refresh interval with sidecar",
+			changes: map[string]string{annotationRefreshInterval: "5m", annotationSidecarContainer: "yes"},
+		},
+		{
+			name:    "refresh interval without sidecar",
+			changes: map[string]string{annotationRefreshInterval: "5m"},
+			errs:    []string{annotationRefreshInterval + `: requires ` + annotationSidecarContainer + ` annotation to be "yes"`},
+		},
+		{
+			name:    "invalid refresh interval",
+			changes: map[string]string{annotationRefreshInterval: "often", annotationSidecarContainer: "yes"},
+			errs:    []string{annotationRefreshInterval + `: "often" must be a positive duration`},
+		},
+		{
+			name: "invalid values",
+			changes: map[string]string{
+				annotationFileMode:      "0999",
+				annotationReloadSignal:  "SIGKILL",
+				annotationSecretsPath:   "secrets",
+				annotationWorkers:       "0",
+				annotationTokenEndpoint: "http://tenant.example.com/token",
+			},
+			errs: []string{
+				annotationFileMode + `: "0999" must be an octal permission`,
+				annotationReloadSignal + `: unknown signal "SIGKILL"`,
+				annotationSecretsPath + `: "secrets" must be an absolute path`,
+				annotationTokenEndpoint + `: "http://tenant.example.com/token" must be an https URL`,
+				annotationWorkers + `: "0" must be a positive number`,
+			},
+		},
+		{
+			name:    "on-secret-change without supervise",
+			changes: map[string]string{annotationOnSecretChange: "signal", annotationReloadSignal: "usr1"},
+			errs:    []string{annotationOnSecretChange + `: requires ` + annotationSupervise + ` annotation to be "yes"`},
+		},
+		{
+			name:    "unknown annotation",
+			changes: map[string]string{annotationPrefix + "tenanturl": "https://tenant.example.com"},
+			errs:    []string{annotationPrefix + "tenanturl: unknown annotation"},
+		},
+		{
+			name:    "no secrets",
+			changes: map[string]string{annotationSecretPrefix + "DB_PASSWORD": "", annotationSecretPrefix + "SYS_PASSWORD": ""},
+			errs:    []string{annotationSecretPrefix + "<name>: at least one password or secret must be checked out"},
+		},
+		{
+			name: "files written twice",
+			changes: map[string]string{
+				annotationSecretPrefix + "DB_PASSWORD": "vault://secret/app/db?file=config.yaml#password",
+				annotationOutput:                       "dotenv,json:config.yaml",
+			},
+			errs: []string{
+				annotationTemplatePrefix + "config.yaml: file config.yaml is also written by " + annotationOutput,
+				annotationSecretPrefix + "DB_PASSWORD: file config.yaml is also written by " + annotationTemplatePrefix + "config.yaml",
+			},
+		},
+		{
+			name:    "invalid output",
+			changes: map[string]string{annotationOutput: "toml"},
+			errs:    []string{annotationOutput + `: unknown output format toml, must be "dotenv", "json" or "yaml"`},
+		},
+		{
+			name:    "invalid template",
+			changes: map[string]string{annotationTemplatePrefix + "config.yaml": "{{ .DB_PASSWORD"},
+			errs:    []string{annotationTemplatePrefix + "config.yaml: invalid template"},
+		},
+		{
+			name:    "template with unknown function",
+			changes: map[string]string{annotationTemplatePrefix + "config.yaml": `{{ upper "a" }}`},
+			errs:    []string{`function "upper" not defined`},
+		},
+		{
+			name:    "hidden template file",
+			changes: map[string]string{annotationTemplatePrefix + ".complete": "{{ .DB_PASSWORD }}"},
+			errs:    []string{annotationTemplatePrefix + `.complete: invalid template: invalid file name ".complete"`},
+		},
+		{
+			name: "container secrets",
+			changes: map[string]string{
+				annotationContainerSecrets + "app":     "DB_PASSWORD,API_KEY",
+				annotationContainerSecrets + "missing": "DB_PASSWORD",
+			},
+			errs: []string{
+				annotationContainerSecrets + "app: secret API_KEY is not defined",
+				annotationContainerSecrets + "missing: pod has no container missing",
+			},
+		},
+		{
+			name:    "invalid secret reference",
+			changes: map[string]string{annotationSecretPrefix + "DB_PASSWORD": "vault://secret/app//db"},
+			errs:    []string{annotationSecretPrefix + `DB_PASSWORD: "vault://secret/app//db" has an empty path segment`},
+		},
+		{
+			name: "not allowed annotations are ignored",
+			changes: map[string]string{
+				annotationFileMode:                      "0999",
+				annotationSecretPrefix + "API_KEY":      "vault://secret/api",
+				annotationContainerSecrets + "app":      "API_KEY",
+				annotationSecretPrefix + "SYS_PASSWORD": "",
+			},
+			config: webhookConfig{AllowedAnnotations: []string{"tenant-url", "auth-type", "appid", "scope", "oauth-secret-name", "template-*", "container-secrets-*", "vaultsecret_DB_*"}},
+			errs:   []string{annotationContainerSecrets + "app: secret API_KEY is not defined"},
+		},
+		{
+			name:    "not allowed annotations don't satisfy requirements",
+			changes: map[string]string{annotationPrefix + "scope-typo": "all"},
+			config:  webhookConfig{AllowedAnnotations: []string{"tenant-url", "auth-type", "appid", "oauth-secret-name", "template-*", "vaultsecret_*"}},
+			errs: []string{
+				annotationPrefix + "scope-typo: unknown annotation",
+				annotationScope + ": annotation is required",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := validateAnnotations(testPod(tt.changes), &tt.config)
+			if len(errs) != len(tt.errs) {
+				t.Fatalf("validateAnnotations() = %q, want %d errors %q", errs, len(tt.errs), tt.errs)
+			}
+			for i, want := range tt.errs {
+				if !strings.Contains(errs[i], want) {
+					t.Errorf("validateAnnotations() error %d = %q, want %q", i, errs[i], want)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateSecretRef(t *testing.T) {
+	tests := []struct {
+		value string
+		file  string
+		err   string
+	}{
+		{value: "vault://secret/name"},
+		{value: "vault://secret/folder1/folder2/name"},
+		{value: "vault://system/MySQL (Demo Lab)/dbadmin"},
+		{value: "vault://database/MSSQL/dbadmin?mode=0400&uid=1000&gid=1000#password"},
+		{value: "vault://domain/example.com/admin?file=admin.pass", file: "admin.pass"},
+		{value: "vault://secret/app/db?field=password#password"},
+		{value: "secret/name", err: "must start with vault://"},
+		{value: "vault://secret", err: "must be vault://secret/<path name>/.../<secret name>"},
+		{value: "vault://secret/", err: "has an empty path segment"},
+		{value: "vault://system/MySQL", err: "must be vault://system/<system name>/<account name>"},
+		{value: "vault://database/MSSQL/dbadmin/extra", err: "must be vault://database/<database name>/<account name>"},
+		{value: "vault://vaults/name", err: "must refer to system, database, domain or secret"},
+		{value: "vault://secret/name?mode=999", err: "has invalid file mode 999"},
+		{value: "vault://secret/name?uid=-1", err: "has invalid uid -1"},
+		{value: "vault://secret/name?file=../etc/passwd", err: `has invalid file name "../etc/passwd"`},
+		{value: "vault://secret/name?file=.complete", err: `has invalid file name ".complete"`},
+		{value: "vault://secret/app/db?field=user#password", err: "has field user that conflicts with #password"},
+		{value: "vault://secret/name?color=red", err: "unknown option color"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			file, err := validateSecretRef(tt.value)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("validateSecretRef() error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("validateSecretRef() error = %v", err)
+			}
+			if file != tt.file {
+				t.Errorf("validateSecretRef() file = %q, want %q", file, tt.file)
+			}
+		})
+	}
+}